@@ -2,25 +2,136 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/nevermore/muyifs/pkg/backend"
+	_ "github.com/nevermore/muyifs/pkg/backend/local"
+	_ "github.com/nevermore/muyifs/pkg/backend/obs"
+	_ "github.com/nevermore/muyifs/pkg/backend/s3"
 	"github.com/nevermore/muyifs/pkg/fuse"
+	"github.com/nevermore/muyifs/pkg/meta"
+	"k8s.io/klog/v2"
 )
 
 func main() {
-	var mountpoint, datapath, compress string
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		gc(os.Args[2:])
+		return
+	}
+
+	var mountpoint, datapath, compress, ak, sk, bucket, region, endpoint string
 	var chunk, fixed bool
 	var opt fuse.Option
 	flag.StringVar(&mountpoint, "mountpoint", "", "dir for mount use")
-	flag.StringVar(&datapath, "datapath", "", "data path to store metadata")
+	flag.StringVar(&datapath, "datapath", "", "dir to store metadata")
 	flag.StringVar(&compress, "compress", "", "compression algorithm for data uploading (snappy/lz4/zstd)")
 	flag.BoolVar(&chunk, "chunk", false, "whether to split data into chunks")
 	flag.BoolVar(&fixed, "fixed", true, "whether to split data in fixed size")
-	flag.StringVar(&opt.Backend, "backend", "s3", "type of object storage (s3 or obs)")
-	flag.StringVar(&opt.Bucket, "bucket", "", "bucket of object storage")
-	flag.StringVar(&opt.Region, "region", "", "region of object storage")
-	flag.StringVar(&opt.AccessKey, "ak", "", "access key of object storage")
-	flag.StringVar(&opt.SerectKey, "sk", "", "secret key of object storage")
-	flag.StringVar(&opt.Endpoint, "endpoint", "", "endpoint of object storage")
+	flag.StringVar(&opt.Backend, "backend", "s3", backendUsage)
+	flag.StringVar(&bucket, "bucket", "", "deprecated, bucket of object storage when -backend is its type")
+	flag.StringVar(&region, "region", "", "deprecated, region of object storage when -backend is its type")
+	flag.StringVar(&endpoint, "endpoint", "", "deprecated, endpoint of object storage when -backend is its type")
+	flag.StringVar(&ak, "ak", "", "access key of object storage")
+	flag.StringVar(&sk, "sk", "", "secret key of object storage")
+	flag.Int64Var(&opt.Readahead, "readahead", fuse.ReadaheadBudget, "memory in bytes for data read ahead of sequential reads")
+	flag.Int64Var(&opt.MemCacheSize, "mem-cache-size", fuse.BlockCacheSize, "memory in bytes for data cached across open files")
+	flag.StringVar(&opt.CacheDir, "cache-dir", "", "dir to cache downloaded data across mounts, none if empty")
+	flag.Int64Var(&opt.CacheSize, "cache-size", fuse.DiskCacheSize, "size in bytes of the cache in cache-dir")
 	flag.Parse()
+
+	opt.Backend = withCredentials(storageSpec(opt.Backend, bucket, region, endpoint), ak, sk)
 	fuse.Mount(mountpoint, datapath, compress, chunk, fixed, &opt)
 }
+
+const backendUsage = "object storage, e.g. s3://bucket?region=r&endpoint=e, obs://bucket or file:///path, " +
+	"or its type (s3 or obs) with the deprecated -bucket, -region and -endpoint"
+
+// storageSpec returns the backend spec of the deprecated -bucket, -region
+// and -endpoint flags when name is only the type of the storage.
+func storageSpec(name, bucket, region, endpoint string) string {
+	if strings.Contains(name, "://") {
+		if bucket != "" || region != "" || endpoint != "" {
+			klog.Warningf("-bucket, -region and -endpoint are ignored with -backend=%s", name)
+		}
+		return name
+	}
+	klog.Warningf("-backend=%s with -bucket, -region and -endpoint is deprecated, use -backend=%s://%s?region=..&endpoint=..", name, name, bucket)
+	q := url.Values{}
+	if region != "" {
+		q.Set("region", region)
+	}
+	if endpoint != "" {
+		q.Set("endpoint", endpoint)
+	}
+	u := &url.URL{Scheme: name, Host: bucket, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// withCredentials adds the access and secret key to a backend spec.
+func withCredentials(spec, ak, sk string) string {
+	if ak == "" && sk == "" {
+		return spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		klog.Fatalf("Invalid backend: %v", err.(*url.Error).Err)
+	}
+	u.User = url.UserPassword(ak, sk)
+	return u.String()
+}
+
+// keptRefs returns the chunk references counted in the metadata under
+// datapath, which must exist.
+func keptRefs(datapath string) (map[string]uint64, error) {
+	m, err := meta.OpenExisting(datapath)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	return m.Refs()
+}
+
+// gc deletes the chunks no file references any more, run as
+// "muyifs gc -backend ...".
+func gc(args []string) {
+	var spec, datapath, ak, sk, bucket, region, endpoint string
+	var opt fuse.GCOption
+	set := flag.NewFlagSet("gc", flag.ExitOnError)
+	set.StringVar(&spec, "backend", "s3", backendUsage)
+	set.StringVar(&bucket, "bucket", "", "deprecated, bucket of object storage when -backend is its type")
+	set.StringVar(&region, "region", "", "deprecated, region of object storage when -backend is its type")
+	set.StringVar(&endpoint, "endpoint", "", "deprecated, endpoint of object storage when -backend is its type")
+	set.StringVar(&ak, "ak", "", "access key of object storage")
+	set.StringVar(&sk, "sk", "", "secret key of object storage")
+	set.StringVar(&datapath, "datapath", "", "metadata dir of an unmounted file system whose chunk references are kept too")
+	set.BoolVar(&opt.DryRun, "dry-run", false, "only list the chunks that would be deleted")
+	set.DurationVar(&opt.Grace, "grace", time.Hour, "keep unreferenced chunks stored less than this ago, for files still being written")
+	set.Parse(args)
+
+	if datapath != "" {
+		var err error
+		if opt.Keep, err = keptRefs(datapath); err != nil {
+			klog.Fatalf("Read chunk references in %s error %v, is it mounted?", datapath, err)
+		}
+	}
+	store, err := backend.New(withCredentials(storageSpec(spec, bucket, region, endpoint), ak, sk))
+	if err != nil {
+		klog.Fatalf("Init backend client error %v", err)
+	}
+	stats, err := fuse.CollectGarbage(store, opt, func(o backend.Object) {
+		fmt.Printf("%s\t%d\t%s\n", o.Key, o.Size, o.Mtime.Format(time.RFC3339))
+	})
+	if err != nil {
+		klog.Fatalf("Collect garbage in %s error %v", store, err)
+	}
+	verb := "deleted"
+	if opt.DryRun {
+		verb = "would delete"
+	}
+	fmt.Printf("%d layouts, %d chunks, %d referenced, %d in grace period, %s %d chunks of %d bytes\n",
+		stats.Layouts, stats.Chunks, stats.Referenced, stats.Young, verb, stats.Deleted, stats.Freed)
+}
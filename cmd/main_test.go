@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nevermore/muyifs/pkg/meta"
+)
+
+func TestStorageSpec(t *testing.T) {
+	for _, c := range []struct {
+		name, bucket, region, endpoint string
+		want                           string
+	}{
+		{"s3", "b", "r", "http://h:9000", "s3://b?endpoint=http%3A%2F%2Fh%3A9000&region=r"},
+		{"obs", "b", "", "", "obs://b"},
+		{"s3://b?region=r", "", "", "", "s3://b?region=r"},
+		{"file:///data", "ignored", "", "", "file:///data"},
+	} {
+		got := storageSpec(c.name, c.bucket, c.region, c.endpoint)
+		if got != c.want {
+			t.Errorf("storageSpec(%q, %q, %q, %q) = %q, want %q", c.name, c.bucket, c.region, c.endpoint, got, c.want)
+		}
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Errorf("storageSpec returned invalid %q: %v", got, err)
+			continue
+		}
+		if c.endpoint != "" && u.Query().Get("endpoint") != c.endpoint {
+			t.Errorf("endpoint of %q = %q", got, u.Query().Get("endpoint"))
+		}
+	}
+}
+
+func TestWithCredentials(t *testing.T) {
+	if got := withCredentials("s3://b?region=r", "", ""); got != "s3://b?region=r" {
+		t.Errorf("withCredentials without keys = %q", got)
+	}
+	u, _ := url.Parse(withCredentials("s3://b?region=r", "ak", "s/k"))
+	sk, _ := u.User.Password()
+	if u.User.Username() != "ak" || sk != "s/k" || u.Host != "b" || u.Query().Get("region") != "r" {
+		t.Errorf("withCredentials = %v", u)
+	}
+}
+
+func TestKeptRefs(t *testing.T) {
+	// a wrong datapath fails instead of keeping no chunk
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := keptRefs(missing); err == nil {
+		t.Fatalf("keptRefs of a missing datapath succeeded")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("keptRefs created %s", missing)
+	}
+
+	dir := t.TempDir()
+	m, err := meta.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if _, err := keptRefs(dir); err != meta.ErrNoRefs {
+		t.Fatalf("keptRefs without counted references = %v", err)
+	}
+
+	m, _ = meta.Open(dir)
+	m.SetRefs(func(layout []byte) []string { return []string{string(layout)} })
+	m.PutInode(&meta.Inode{Ino: 2, Layout: []byte("c")})
+	m.Close()
+	refs, err := keptRefs(dir)
+	if err != nil || refs["c"] != 1 {
+		t.Fatalf("keptRefs = %v, %v", refs, err)
+	}
+}
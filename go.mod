@@ -10,5 +10,6 @@ require (
 	github.com/huaweicloud/huaweicloud-sdk-go-obs v3.21.1+incompatible
 	github.com/hungys/go-lz4 v0.0.0-20170805124057-19ff7f07f099
 	github.com/restic/chunker v0.4.0
+	go.etcd.io/bbolt v1.3.5
 	k8s.io/klog/v2 v2.3.0
 )
@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// MaxCopySize is the largest object a single server-side copy can
+	// handle, larger objects are copied part by part.
+	MaxCopySize = 5 << 30
+	// CopyPartSize is the size of each part of a multipart copy.
+	CopyPartSize = 1 << 30
+
+	fallbackPartSize = 1 << 26
+)
+
+// UploadPartCopyFallback uploads a range of src as a part through Get and
+// UploadPart for backends without server-side part copy.
+func UploadPartCopyFallback(s ObjectStorage, key, uploadID string, num int, src string, off, size int64) (*Part, error) {
+	buf := make([]byte, size)
+	n, err := s.Get(src, off, size, buf)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) < size {
+		return nil, fmt.Errorf("copy part of %s: short read %d < %d", src, n, size)
+	}
+	return s.UploadPart(key, uploadID, num, buf)
+}
+
+// CopyFallback copies src to dst through Get and Put for backends without
+// server-side copy. Objects larger than one part are uploaded as a multipart
+// upload, which does not carry over the object metadata.
+func CopyFallback(s ObjectStorage, src, dst string) error {
+	o, err := s.Head(src)
+	if err != nil {
+		return err
+	}
+	if o.Size <= fallbackPartSize {
+		buf := make([]byte, o.Size+1)
+		n, err := s.Get(src, 0, -1, buf)
+		if err != nil {
+			return err
+		}
+		return s.Put(dst, o.Metadata, bytes.NewReader(buf[:n]))
+	}
+
+	mu, err := s.InitiateMultipartUpload(dst)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, fallbackPartSize)
+	var parts []*Part
+	for off, num := int64(0), 1; off < o.Size; off, num = off+fallbackPartSize, num+1 {
+		n, err := s.Get(src, off, fallbackPartSize, buf)
+		if err == nil {
+			var part *Part
+			part, err = s.UploadPart(dst, mu.UploadID, num, buf[:n])
+			parts = append(parts, part)
+		}
+		if err != nil {
+			s.AbortUpload(dst, mu.UploadID)
+			return err
+		}
+	}
+	return s.CompleteUpload(dst, mu.UploadID, parts)
+}
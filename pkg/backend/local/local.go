@@ -0,0 +1,376 @@
+package local
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+	"k8s.io/klog/v2"
+)
+
+func init() {
+	backend.Register("file", func(u *url.URL) (backend.ObjectStorage, error) {
+		return NewLocalClient(u.Host + u.Path)
+	})
+}
+
+// localClient keeps every object as a file under root. The "/" separated
+// segments of a key map to directories, so that the objects under a prefix
+// are a subtree. A key can be both an object and the prefix of other
+// objects, e.g. a chunked file and its <key>/N chunks, so every name starts
+// with its kind: a directory of a segment, the data of an object or its
+// metadata, followed by the escaped segment.
+type localClient struct {
+	root string
+}
+
+type object struct {
+	Key      string            `json:"key"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+const (
+	objectDir = "keys"
+	uploadDir = "uploads"
+	uploadKey = "key"
+
+	dirKind  = 'd'
+	dataKind = 'o'
+	attrKind = 'm'
+	tempFile = ".tmp-"
+)
+
+func NewLocalClient(root string) (*localClient, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", root, err)
+	}
+	return &localClient{
+		root: root,
+	}, nil
+}
+
+func (s *localClient) String() string {
+	return fmt.Sprintf("file://%s", s.root)
+}
+
+func (s *localClient) Create() error {
+	for _, d := range []string{objectDir, uploadDir} {
+		if err := os.MkdirAll(filepath.Join(s.root, d), 0755); err != nil {
+			klog.Errorf("Create Local directory %v error %v", d, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// dir returns the directory holding the objects of the segments of key
+// before its last "/".
+func (s *localClient) dir(key string) string {
+	p := []string{s.root, objectDir}
+	segs := strings.Split(key, "/")
+	for _, seg := range segs[:len(segs)-1] {
+		p = append(p, string(dirKind)+url.PathEscape(seg))
+	}
+	return filepath.Join(p...)
+}
+
+// path returns the files holding the data and the metadata of key.
+func (s *localClient) path(key string) (data, attr string) {
+	dir := s.dir(key)
+	name := url.PathEscape(key[strings.LastIndex(key, "/")+1:])
+	return filepath.Join(dir, string(dataKind)+name), filepath.Join(dir, string(attrKind)+name)
+}
+
+// writeFile writes the file through a temporary file so readers never see
+// a partial object.
+func writeFile(name string, in io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), tempFile)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *localClient) readAttr(p string) (*object, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	o := &object{}
+	if err := json.Unmarshal(b, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (s *localClient) Head(key string) (backend.Object, error) {
+	data, attr := s.path(key)
+	o, err := s.readAttr(attr)
+	if err != nil {
+		klog.Errorf("Head Local %v Metadata error %v", key, err)
+		return backend.Object{}, err
+	}
+	fi, err := os.Stat(data)
+	if err != nil {
+		klog.Errorf("Head Local %v Metadata error %v", key, err)
+		return backend.Object{}, err
+	}
+	return backend.Object{
+		Key:      key,
+		Size:     fi.Size(),
+		Mtime:    fi.ModTime(),
+		IsDir:    strings.HasSuffix(key, "/"),
+		Metadata: o.Metadata,
+	}, nil
+}
+
+func (s *localClient) Get(key string, off, limit int64, buf []byte) (int, error) {
+	data, _ := s.path(key)
+	f, err := os.Open(data)
+	if err != nil {
+		klog.Errorf("Get Local %v Object error %v", key, err)
+		return 0, err
+	}
+	defer f.Close()
+	if limit > 0 && limit < int64(len(buf)) {
+		buf = buf[:limit]
+	}
+	n, err := f.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		klog.Errorf("Read Local %v Object error %v", key, err)
+		return 0, err
+	}
+	return n, nil
+}
+
+// put stores the metadata before the data, an object is only listed once
+// its data is there.
+func (s *localClient) put(key string, metadata map[string]string, in io.Reader) error {
+	data, attr := s.path(key)
+	b, err := json.Marshal(&object{Key: key, Metadata: metadata})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(attr, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	return writeFile(data, in)
+}
+
+func (s *localClient) Put(key string, metadata map[string]string, in io.Reader) error {
+	err := s.put(key, metadata, in)
+	if err != nil {
+		klog.Errorf("Put Local %v Object error %v", key, err)
+	}
+	return err
+}
+
+func (s *localClient) PutDirectory(key string) error {
+	err := s.put(key, nil, strings.NewReader(""))
+	if err != nil {
+		klog.Errorf("PutDirectory Local %v Object error %v", key, err)
+	}
+	return err
+}
+
+func (s *localClient) Copy(src, dst string) error {
+	err := backend.CopyFallback(s, src, dst)
+	if err != nil {
+		klog.Errorf("Copy Local %v to %v Object error %v", src, dst, err)
+	}
+	return err
+}
+
+func (s *localClient) Delete(key string) error {
+	data, attr := s.path(key)
+	if err := os.Remove(data); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(attr); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localClient) DeleteList(key string) error {
+	objects, err := s.List(key)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := s.Delete(o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List only walks the directory of the segments of prefix before its last
+// "/".
+func (s *localClient) List(prefix string) ([]backend.Object, error) {
+	i := strings.LastIndex(prefix, "/") + 1
+	var obj []backend.Object
+	if err := s.list(s.dir(prefix), prefix[:i], prefix[i:], &obj); err != nil {
+		klog.Errorf("List Local Object error %v", err)
+		return obj, err
+	}
+	sort.Slice(obj, func(i, j int) bool {
+		return obj[i].Key < obj[j].Key
+	})
+	return obj, nil
+}
+
+// list adds the objects in dir, which holds the keys starting with parent,
+// whose next segment starts with match.
+func (s *localClient) list(dir, parent, match string, obj *[]backend.Object) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		name := fi.Name()
+		if name == "" || strings.HasPrefix(name, tempFile) {
+			continue
+		}
+		seg, err := url.PathUnescape(name[1:])
+		if err != nil || !strings.HasPrefix(seg, match) {
+			continue
+		}
+		switch name[0] {
+		case dirKind:
+			if err := s.list(filepath.Join(dir, name), parent+seg+"/", "", obj); err != nil {
+				return err
+			}
+		case dataKind:
+			*obj = append(*obj, backend.Object{
+				Key:   parent + seg,
+				Size:  fi.Size(),
+				Mtime: fi.ModTime(),
+				IsDir: strings.HasSuffix(parent+seg, "/"),
+			})
+		}
+	}
+	return nil
+}
+
+func (s *localClient) uploadPath(uploadID string, name string) string {
+	return filepath.Join(s.root, uploadDir, uploadID, name)
+}
+
+func (s *localClient) checkUpload(key string, uploadID string) error {
+	b, err := ioutil.ReadFile(s.uploadPath(uploadID, uploadKey))
+	if err != nil {
+		return err
+	}
+	if string(b) != key {
+		return fmt.Errorf("upload %s does not belong to %s", uploadID, key)
+	}
+	return nil
+}
+
+func (s *localClient) InitiateMultipartUpload(key string) (*backend.MultipartUpload, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	uploadID := hex.EncodeToString(id)
+	if err := writeFile(s.uploadPath(uploadID, uploadKey), strings.NewReader(key)); err != nil {
+		klog.Errorf("InitiateMultipartUpload Local %v Object error %v", key, err)
+		return nil, err
+	}
+	return &backend.MultipartUpload{
+		MinPartSize: 5 << 20,
+		MaxCount:    10000,
+		UploadID:    uploadID,
+	}, nil
+}
+
+func (s *localClient) UploadPart(key string, uploadID string, num int, body []byte) (*backend.Part, error) {
+	if err := s.checkUpload(key, uploadID); err != nil {
+		klog.Errorf("UploadPart Local %v Object error %v", key, err)
+		return nil, err
+	}
+	if err := writeFile(s.uploadPath(uploadID, strconv.Itoa(num)), bytes.NewReader(body)); err != nil {
+		klog.Errorf("UploadPart Local %v Object error %v", key, err)
+		return nil, err
+	}
+	sum := md5.Sum(body)
+	return &backend.Part{
+		Num:  num,
+		Size: len(body),
+		ETag: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func (s *localClient) UploadPartCopy(key string, uploadID string, num int, src string, off, size int64) (*backend.Part, error) {
+	part, err := backend.UploadPartCopyFallback(s, key, uploadID, num, src, off, size)
+	if err != nil {
+		klog.Errorf("UploadPartCopy Local %v from %v error %v", key, src, err)
+	}
+	return part, err
+}
+
+func (s *localClient) AbortUpload(key string, uploadID string) error {
+	if err := s.checkUpload(key, uploadID); err != nil {
+		klog.Errorf("AbortUpload Local %v Object error %v", key, err)
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.root, uploadDir, uploadID))
+}
+
+func (s *localClient) CompleteUpload(key string, uploadID string, parts []*backend.Part) error {
+	if err := s.checkUpload(key, uploadID); err != nil {
+		klog.Errorf("CompleteUpload Local %v Object error %v", key, err)
+		return err
+	}
+	readers := make([]io.Reader, 0, len(parts))
+	for i, p := range parts {
+		if i > 0 && p.Num <= parts[i-1].Num {
+			return fmt.Errorf("parts of %s are not in ascending order", key)
+		}
+		f, err := os.Open(s.uploadPath(uploadID, strconv.Itoa(p.Num)))
+		if err != nil {
+			klog.Errorf("CompleteUpload Local %v Object error %v", key, err)
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	if err := s.put(key, nil, io.MultiReader(readers...)); err != nil {
+		klog.Errorf("CompleteUpload Local %v Object error %v", key, err)
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.root, uploadDir, uploadID))
+}
@@ -0,0 +1,222 @@
+package local
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+)
+
+func newTestClient(t *testing.T) *localClient {
+	s, err := NewLocalClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func keys(objs []backend.Object) []string {
+	var s []string
+	for _, o := range objs {
+		s = append(s, o.Key)
+	}
+	return s
+}
+
+func TestPutHeadGet(t *testing.T) {
+	s := newTestClient(t)
+	data := []byte("hello, world")
+	if err := s.Put("a/b", map[string]string{"k": "v"}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	o, err := s.Head("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Key != "a/b" || o.Size != int64(len(data)) || o.IsDir || o.Metadata["k"] != "v" {
+		t.Fatalf("Head = %+v", o)
+	}
+
+	buf := make([]byte, 100)
+	n, err := s.Get("a/b", 0, -1, buf)
+	if err != nil || !bytes.Equal(buf[:n], data) {
+		t.Fatalf("Get = %q, %v", buf[:n], err)
+	}
+	n, err = s.Get("a/b", 7, 3, buf)
+	if err != nil || string(buf[:n]) != "wor" {
+		t.Fatalf("ranged Get = %q, %v", buf[:n], err)
+	}
+	if _, err := s.Head("a"); err == nil {
+		t.Fatalf("Head of a prefix found an object")
+	}
+	if _, err := s.Get("a/c", 0, -1, buf); err == nil {
+		t.Fatalf("Get of a missing object succeeded")
+	}
+}
+
+func TestListPrefix(t *testing.T) {
+	s := newTestClient(t)
+	all := []string{
+		"a", "a/", "a/.meta", "a/0", "a/1", "ab", "b/%2F x", "b/..", "b//c", "chunks/ff",
+	}
+	for _, k := range all {
+		if err := s.Put(k, nil, strings.NewReader(k)); err != nil {
+			t.Fatalf("Put %q: %v", k, err)
+		}
+	}
+	for _, c := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"", all},
+		{"a", []string{"a", "a/", "a/.meta", "a/0", "a/1", "ab"}},
+		{"a/", []string{"a/", "a/.meta", "a/0", "a/1"}},
+		{"a/.", []string{"a/.meta"}},
+		{"b/", []string{"b/%2F x", "b/..", "b//c"}},
+		{"b//", []string{"b//c"}},
+		{"c", []string{"chunks/ff"}},
+		{"d/", nil},
+	} {
+		objs, err := s.List(c.prefix)
+		if err != nil {
+			t.Fatalf("List %q: %v", c.prefix, err)
+		}
+		if got := keys(objs); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("List %q = %q, want %q", c.prefix, got, c.want)
+		}
+		for _, o := range objs {
+			if o.Size != int64(len(o.Key)) || o.IsDir != strings.HasSuffix(o.Key, "/") {
+				t.Errorf("List %q returned %+v", c.prefix, o)
+			}
+		}
+	}
+
+	// A prefix only walks its own subtree, a broken directory elsewhere
+	// does not matter.
+	if err := ioutil.WriteFile(filepath.Join(s.root, objectDir, "dz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if objs, err := s.List("a/"); err != nil || len(objs) != 4 {
+		t.Fatalf("List %q = %q, %v", "a/", keys(objs), err)
+	}
+	if _, err := s.List(""); err == nil {
+		t.Fatalf("List of all objects read past the broken directory")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := newTestClient(t)
+	for _, k := range []string{"a", "a/0", "a/1", "ab"} {
+		s.Put(k, nil, strings.NewReader(k))
+	}
+	if err := s.DeleteList("a/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("ab"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("missing"); err != nil {
+		t.Fatalf("Delete of a missing object: %v", err)
+	}
+	objs, _ := s.List("")
+	if got := keys(objs); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("List after delete = %q", got)
+	}
+	if _, err := s.Head("a/0"); err == nil {
+		t.Fatalf("Head of a deleted object succeeded")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s := newTestClient(t)
+	small := []byte("small")
+	large := bytes.Repeat([]byte("0123456789abcdef"), 4<<20+1)
+	s.Put("small", map[string]string{"k": "v"}, bytes.NewReader(small))
+	s.Put("large", nil, bytes.NewReader(large))
+	for _, c := range []struct {
+		src  string
+		data []byte
+	}{{"small", small}, {"large", large}} {
+		if err := s.Copy(c.src, "d/"+c.src); err != nil {
+			t.Fatalf("Copy %s: %v", c.src, err)
+		}
+		buf := make([]byte, len(c.data)+1)
+		n, err := s.Get("d/"+c.src, 0, -1, buf)
+		if err != nil || !bytes.Equal(buf[:n], c.data) {
+			t.Fatalf("copy of %s read back %d bytes, %v", c.src, n, err)
+		}
+	}
+	if o, _ := s.Head("d/small"); o.Metadata["k"] != "v" {
+		t.Fatalf("copy lost the metadata: %+v", o)
+	}
+	// a copy onto itself keeps the data and refreshes the mtime
+	before, _ := s.Head("small")
+	time.Sleep(10 * time.Millisecond)
+	if err := s.Copy("small", "small"); err != nil {
+		t.Fatalf("Copy onto itself: %v", err)
+	}
+	buf := make([]byte, len(small)+1)
+	o, _ := s.Head("small")
+	if n, _ := s.Get("small", 0, -1, buf); !bytes.Equal(buf[:n], small) || o.Metadata["k"] != "v" || !o.Mtime.After(before.Mtime) {
+		t.Fatalf("copy onto itself left %q, %+v", buf[:n], o)
+	}
+	if err := s.Copy("missing", "d/missing"); err == nil {
+		t.Fatalf("Copy of a missing object succeeded")
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	s := newTestClient(t)
+	src := bytes.Repeat([]byte("0123456789"), 100)
+	s.Put("src", nil, bytes.NewReader(src))
+
+	mu, err := s.InitiateMultipartUpload("dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := s.UploadPart("dst", mu.UploadID, 2, []byte("tail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, err := s.UploadPartCopy("dst", mu.UploadID, 1, "src", 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UploadPart("other", mu.UploadID, 3, nil); err == nil {
+		t.Fatalf("UploadPart to the upload of another key succeeded")
+	}
+	if _, err := s.Head("dst"); err == nil {
+		t.Fatalf("object exists before the upload completes")
+	}
+	if err := s.CompleteUpload("dst", mu.UploadID, []*backend.Part{p1, p2}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, _ := s.Get("dst", 0, -1, buf)
+	if want := string(src[10:30]) + "tail"; string(buf[:n]) != want {
+		t.Fatalf("completed object = %q, want %q", buf[:n], want)
+	}
+
+	mu, err = s.InitiateMultipartUpload("aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UploadPart("aborted", mu.UploadID, 1, []byte("x"))
+	if err := s.AbortUpload("aborted", mu.UploadID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CompleteUpload("aborted", mu.UploadID, nil); err == nil {
+		t.Fatalf("CompleteUpload of an aborted upload succeeded")
+	}
+	if objs, _ := s.List("aborted"); len(objs) != 0 {
+		t.Fatalf("aborted upload left %q", keys(objs))
+	}
+}
@@ -0,0 +1,353 @@
+package mem
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+	"k8s.io/klog/v2"
+)
+
+var (
+	ErrNotFound = errors.New("mem: object not found")
+	ErrInjected = errors.New("mem: injected fault")
+)
+
+func init() {
+	backend.Register("mem", func(u *url.URL) (backend.ObjectStorage, error) {
+		return NewMemClient(u.Host), nil
+	})
+}
+
+// Faults describes the failures injected into a memory backend.
+type Faults struct {
+	// Latency is added to every call.
+	Latency time.Duration
+	// FailUploadPart fails the Nth UploadPart call, counted from 1.
+	FailUploadPart int
+	// FailPut fails the Nth Put call, counted from 1.
+	FailPut int
+	// FailCopy fails the Nth Copy call, counted from 1.
+	FailCopy int
+	// TruncateGet cuts every Get body to at most this many bytes.
+	TruncateGet int
+	// HeadNotFound makes Head report every object as missing.
+	HeadNotFound bool
+}
+
+type object struct {
+	data     []byte
+	mtime    time.Time
+	metadata map[string]string
+}
+
+type upload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// memClient keeps all objects in maps, it is meant for tests.
+type memClient struct {
+	sync.Mutex
+	name        string
+	objects     map[string]*object
+	uploads     map[string]*upload
+	nextUpload  int
+	faults      Faults
+	uploadParts int
+	puts        int
+	copies      int
+}
+
+func NewMemClient(name string) *memClient {
+	return &memClient{
+		name:    name,
+		objects: make(map[string]*object),
+		uploads: make(map[string]*upload),
+	}
+}
+
+// SetFaults replaces the injected faults and resets the call counters.
+func (s *memClient) SetFaults(f Faults) {
+	s.Lock()
+	defer s.Unlock()
+	s.faults = f
+	s.uploadParts = 0
+	s.puts = 0
+	s.copies = 0
+}
+
+// Uploads returns the number of multipart uploads neither completed nor
+// aborted.
+func (s *memClient) Uploads() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.uploads)
+}
+
+func (s *memClient) delay() {
+	s.Lock()
+	d := s.faults.Latency
+	s.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (s *memClient) String() string {
+	return fmt.Sprintf("mem://%s", s.name)
+}
+
+func (s *memClient) Create() error {
+	return nil
+}
+
+func (s *memClient) Head(key string) (backend.Object, error) {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.objects[key]
+	if !ok || s.faults.HeadNotFound {
+		klog.Errorf("Head Mem %v Metadata error %v", key, ErrNotFound)
+		return backend.Object{}, ErrNotFound
+	}
+	m := make(map[string]string, len(o.metadata))
+	for k, v := range o.metadata {
+		m[k] = v
+	}
+	return backend.Object{
+		Key:      key,
+		Size:     int64(len(o.data)),
+		Mtime:    o.mtime,
+		IsDir:    strings.HasSuffix(key, "/"),
+		Metadata: m,
+	}, nil
+}
+
+func (s *memClient) Get(key string, off, limit int64, buf []byte) (int, error) {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		klog.Errorf("Get Mem %v Object error %v", key, ErrNotFound)
+		return 0, ErrNotFound
+	}
+	if off >= int64(len(o.data)) {
+		return 0, nil
+	}
+	data := o.data[off:]
+	if limit > 0 && limit < int64(len(data)) {
+		data = data[:limit]
+	}
+	if s.faults.TruncateGet > 0 && s.faults.TruncateGet < len(data) {
+		data = data[:s.faults.TruncateGet]
+	}
+	return copy(buf, data), nil
+}
+
+func (s *memClient) Put(key string, metadata map[string]string, in io.Reader) error {
+	s.delay()
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		klog.Errorf("Put Mem %v Object error %v", key, err)
+		return err
+	}
+	m := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		m[k] = v
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.puts++
+	if s.puts == s.faults.FailPut {
+		klog.Errorf("Put Mem %v Object error %v", key, ErrInjected)
+		return ErrInjected
+	}
+	s.objects[key] = &object{data: data, mtime: time.Now(), metadata: m}
+	return nil
+}
+
+func (s *memClient) PutDirectory(key string) error {
+	return s.Put(key, nil, bytes.NewReader(nil))
+}
+
+func (s *memClient) Copy(src, dst string) error {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	s.copies++
+	if s.copies == s.faults.FailCopy {
+		klog.Errorf("Copy Mem %v to %v Object error %v", src, dst, ErrInjected)
+		return ErrInjected
+	}
+	o, ok := s.objects[src]
+	if !ok {
+		klog.Errorf("Copy Mem %v to %v Object error %v", src, dst, ErrNotFound)
+		return ErrNotFound
+	}
+	s.objects[dst] = &object{data: o.data, mtime: time.Now(), metadata: o.metadata}
+	return nil
+}
+
+func (s *memClient) Delete(key string) error {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memClient) DeleteList(key string) error {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	for k := range s.objects {
+		if strings.HasPrefix(k, key) {
+			delete(s.objects, k)
+		}
+	}
+	return nil
+}
+
+func (s *memClient) List(prefix string) ([]backend.Object, error) {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	var obj []backend.Object
+	for k, o := range s.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		obj = append(obj, backend.Object{
+			Key:   k,
+			Size:  int64(len(o.data)),
+			Mtime: o.mtime,
+			IsDir: strings.HasSuffix(k, "/"),
+		})
+	}
+	sort.Slice(obj, func(i, j int) bool {
+		return obj[i].Key < obj[j].Key
+	})
+	return obj, nil
+}
+
+func (s *memClient) InitiateMultipartUpload(key string) (*backend.MultipartUpload, error) {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	s.nextUpload++
+	uploadID := strconv.Itoa(s.nextUpload)
+	s.uploads[uploadID] = &upload{key: key, parts: make(map[int][]byte)}
+	return &backend.MultipartUpload{
+		MinPartSize: 5 << 20,
+		MaxCount:    10000,
+		UploadID:    uploadID,
+	}, nil
+}
+
+func (s *memClient) getUpload(key string, uploadID string) (*upload, error) {
+	u, ok := s.uploads[uploadID]
+	if !ok || u.key != key {
+		return nil, fmt.Errorf("mem: no upload %q for %s", uploadID, key)
+	}
+	return u, nil
+}
+
+func (s *memClient) UploadPart(key string, uploadID string, num int, body []byte) (*backend.Part, error) {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	s.uploadParts++
+	if s.uploadParts == s.faults.FailUploadPart {
+		klog.Errorf("UploadPart Mem %v Object error %v", key, ErrInjected)
+		return nil, ErrInjected
+	}
+	u, err := s.getUpload(key, uploadID)
+	if err != nil {
+		klog.Errorf("UploadPart Mem %v Object error %v", key, err)
+		return nil, err
+	}
+	u.parts[num] = append([]byte(nil), body...)
+	sum := md5.Sum(body)
+	return &backend.Part{
+		Num:  num,
+		Size: len(body),
+		ETag: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func (s *memClient) UploadPartCopy(key string, uploadID string, num int, src string, off, size int64) (*backend.Part, error) {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.objects[src]
+	if !ok {
+		klog.Errorf("UploadPartCopy Mem %v from %v error %v", key, src, ErrNotFound)
+		return nil, ErrNotFound
+	}
+	if off+size > int64(len(o.data)) {
+		return nil, fmt.Errorf("mem: range %d-%d out of %s", off, off+size-1, src)
+	}
+	u, err := s.getUpload(key, uploadID)
+	if err != nil {
+		klog.Errorf("UploadPartCopy Mem %v from %v error %v", key, src, err)
+		return nil, err
+	}
+	body := append([]byte(nil), o.data[off:off+size]...)
+	u.parts[num] = body
+	sum := md5.Sum(body)
+	return &backend.Part{
+		Num:  num,
+		Size: len(body),
+		ETag: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func (s *memClient) AbortUpload(key string, uploadID string) error {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.getUpload(key, uploadID); err != nil {
+		klog.Errorf("AbortUpload Mem %v Object error %v", key, err)
+		return err
+	}
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *memClient) CompleteUpload(key string, uploadID string, parts []*backend.Part) error {
+	s.delay()
+	s.Lock()
+	defer s.Unlock()
+	u, err := s.getUpload(key, uploadID)
+	if err != nil {
+		klog.Errorf("CompleteUpload Mem %v Object error %v", key, err)
+		return err
+	}
+	var data []byte
+	for i, p := range parts {
+		if i > 0 && p.Num <= parts[i-1].Num {
+			return fmt.Errorf("mem: parts of %s are not in ascending order", key)
+		}
+		body, ok := u.parts[p.Num]
+		if !ok {
+			return fmt.Errorf("mem: part %d of %s was not uploaded", p.Num, key)
+		}
+		data = append(data, body...)
+	}
+	s.objects[key] = &object{data: data, mtime: time.Now(), metadata: map[string]string{}}
+	delete(s.uploads, uploadID)
+	return nil
+}
@@ -0,0 +1,129 @@
+package mem
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+)
+
+func TestObjects(t *testing.T) {
+	s := NewMemClient("t")
+	if err := s.Put("a/b", map[string]string{"k": "v"}, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a/c", nil, strings.NewReader(""))
+	s.Put("b", nil, strings.NewReader(""))
+	o, err := s.Head("a/b")
+	if err != nil || o.Size != 5 || o.Metadata["k"] != "v" {
+		t.Fatalf("Head = %+v, %v", o, err)
+	}
+	buf := make([]byte, 10)
+	if n, err := s.Get("a/b", 1, 3, buf); err != nil || string(buf[:n]) != "ell" {
+		t.Fatalf("ranged Get = %q, %v", buf[:n], err)
+	}
+	objs, _ := s.List("a/")
+	if len(objs) != 2 || objs[0].Key != "a/b" || objs[1].Key != "a/c" {
+		t.Fatalf("List = %+v", objs)
+	}
+	if err := s.Copy("a/b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	s.DeleteList("a/")
+	if objs, _ := s.List(""); len(objs) != 2 {
+		t.Fatalf("List after DeleteList = %+v", objs)
+	}
+	if _, err := s.Head("a/b"); err != ErrNotFound {
+		t.Fatalf("Head of a deleted object = %v", err)
+	}
+}
+
+func TestFailUploadPart(t *testing.T) {
+	s := NewMemClient("t")
+	s.SetFaults(Faults{FailUploadPart: 2})
+	mu, _ := s.InitiateMultipartUpload("k")
+	p1, err := s.UploadPart("k", mu.UploadID, 1, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UploadPart("k", mu.UploadID, 2, []byte("b")); err != ErrInjected {
+		t.Fatalf("second UploadPart = %v, want ErrInjected", err)
+	}
+	p3, err := s.UploadPart("k", mu.UploadID, 3, []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Uploads() != 1 {
+		t.Fatalf("Uploads = %d, want 1", s.Uploads())
+	}
+	if err := s.CompleteUpload("k", mu.UploadID, []*backend.Part{p1, p3}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if n, _ := s.Get("k", 0, -1, buf); string(buf[:n]) != "ac" {
+		t.Fatalf("completed object = %q", buf[:n])
+	}
+	if s.Uploads() != 0 {
+		t.Fatalf("Uploads after complete = %d", s.Uploads())
+	}
+}
+
+func TestFailPut(t *testing.T) {
+	s := NewMemClient("t")
+	s.SetFaults(Faults{FailPut: 2})
+	if err := s.Put("a", nil, strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("b", nil, strings.NewReader("b")); err != ErrInjected {
+		t.Fatalf("second Put = %v, want ErrInjected", err)
+	}
+	if _, err := s.Head("b"); err != ErrNotFound {
+		t.Fatalf("failed Put stored an object")
+	}
+	// SetFaults resets the count
+	s.SetFaults(Faults{FailPut: 1})
+	if err := s.Put("c", nil, strings.NewReader("c")); err != ErrInjected {
+		t.Fatalf("Put after SetFaults = %v, want ErrInjected", err)
+	}
+}
+
+func TestFailCopy(t *testing.T) {
+	s := NewMemClient("t")
+	s.Put("a", nil, strings.NewReader("a"))
+	s.SetFaults(Faults{FailCopy: 2})
+	if err := s.Copy("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Copy("a", "c"); err != ErrInjected {
+		t.Fatalf("second Copy = %v, want ErrInjected", err)
+	}
+	if _, err := s.Head("c"); err != ErrNotFound {
+		t.Fatalf("failed Copy stored an object")
+	}
+}
+
+func TestTruncateGetAndHeadNotFound(t *testing.T) {
+	s := NewMemClient("t")
+	s.Put("k", nil, bytes.NewReader(make([]byte, 100)))
+	s.SetFaults(Faults{TruncateGet: 10, HeadNotFound: true})
+	buf := make([]byte, 100)
+	if n, err := s.Get("k", 0, -1, buf); err != nil || n != 10 {
+		t.Fatalf("truncated Get = %d, %v", n, err)
+	}
+	if _, err := s.Head("k"); err != ErrNotFound {
+		t.Fatalf("Head = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	s := NewMemClient("t")
+	s.SetFaults(Faults{Latency: 20 * time.Millisecond})
+	start := time.Now()
+	s.Put("k", nil, strings.NewReader(""))
+	s.Head("k")
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("two calls took %v", d)
+	}
+}
@@ -32,11 +32,14 @@ type ObjectStorage interface {
 	Get(key string, off, limit int64, buf []byte) (int, error)
 	Put(key string, metadata map[string]string, in io.Reader) error
 	PutDirectory(key string) error
+	Copy(src, dst string) error
 	Delete(key string) error
 	DeleteList(key string) error
 	List(prefix string) ([]Object, error)
 	InitiateMultipartUpload(key string) (*MultipartUpload, error)
 	UploadPart(key string, uploadID string, num int, body []byte) (*Part, error)
+	// UploadPartCopy uploads size bytes at off of the object src as a part.
+	UploadPartCopy(key string, uploadID string, num int, src string, off, size int64) (*Part, error)
 	AbortUpload(key string, uploadID string) error
 	CompleteUpload(key string, uploadID string, parts []*Part) error
 }
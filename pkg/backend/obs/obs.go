@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"strings"
 
 	"github.com/huaweicloud/huaweicloud-sdk-go-obs/obs"
@@ -12,6 +13,14 @@ import (
 	"k8s.io/klog/v2"
 )
 
+func init() {
+	backend.Register("obs", func(u *url.URL) (backend.ObjectStorage, error) {
+		ak, sk := backend.Credentials(u)
+		q := u.Query()
+		return NewObsClient(u.Host, q.Get("region"), ak, sk, q.Get("endpoint"))
+	})
+}
+
 type obsClient struct {
 	bucket string
 	region string
@@ -71,6 +80,11 @@ func (s *obsClient) Get(key string, off, limit int64, buf []byte) (int, error) {
 	if limit > 0 {
 		params.RangeEnd = off + limit - 1
 	}
+	if limit == 1 {
+		// The SDK leaves out a range of one byte, ask for two and keep one.
+		params.RangeEnd = off + 1
+		buf = buf[:1]
+	}
 	output, err := s.c.GetObject(params)
 	if err != nil && err != io.EOF {
 		klog.Errorf("Get OBS %v Object error %v", key, err)
@@ -88,6 +102,9 @@ func (s *obsClient) Get(key string, off, limit int64, buf []byte) (int, error) {
 			return 0, err
 		}
 		inx += count
+		if inx == len(buf) {
+			return inx, nil
+		}
 	}
 }
 
@@ -125,6 +142,55 @@ func (s *obsClient) PutDirectory(key string) error {
 	return err
 }
 
+func (s *obsClient) Copy(src, dst string) error {
+	o, err := s.Head(src)
+	if err != nil {
+		return err
+	}
+	if o.Size <= backend.MaxCopySize {
+		params := &obs.CopyObjectInput{}
+		params.Bucket = s.bucket
+		params.Key = dst
+		params.CopySourceBucket = s.bucket
+		params.CopySourceKey = src
+		if src == dst {
+			// A copy onto itself only refreshes the mtime, OBS takes it
+			// when the metadata is replaced.
+			params.MetadataDirective = obs.ReplaceMetadata
+			params.Metadata = o.Metadata
+		}
+		if _, err := s.c.CopyObject(params); err != nil {
+			klog.Errorf("Copy OBS %v to %v Object error %v", src, dst, err)
+			return err
+		}
+		return nil
+	}
+
+	input := &obs.InitiateMultipartUploadInput{}
+	input.Bucket = s.bucket
+	input.Key = dst
+	input.Metadata = o.Metadata
+	output, err := s.c.InitiateMultipartUpload(input)
+	if err != nil {
+		klog.Errorf("Copy OBS %v to %v Object error %v", src, dst, err)
+		return err
+	}
+	var parts []*backend.Part
+	for off, num := int64(0), 1; off < o.Size; off, num = off+backend.CopyPartSize, num+1 {
+		end := off + backend.CopyPartSize
+		if end > o.Size {
+			end = o.Size
+		}
+		part, err := s.UploadPartCopy(dst, output.UploadId, num, src, off, end-off)
+		if err != nil {
+			s.AbortUpload(dst, output.UploadId)
+			return err
+		}
+		parts = append(parts, part)
+	}
+	return s.CompleteUpload(dst, output.UploadId, parts)
+}
+
 func (s *obsClient) Delete(key string) error {
 	params := &obs.DeleteObjectInput{}
 	params.Bucket = s.bucket
@@ -213,6 +279,32 @@ func (s *obsClient) UploadPart(key string, uploadID string, num int, body []byte
 	}, nil
 }
 
+func (s *obsClient) UploadPartCopy(key string, uploadID string, num int, src string, off, size int64) (*backend.Part, error) {
+	if size == 1 {
+		// The SDK leaves out a range of one byte, which would copy all of src.
+		return backend.UploadPartCopyFallback(s, key, uploadID, num, src, off, size)
+	}
+	params := &obs.CopyPartInput{}
+	params.Bucket = s.bucket
+	params.Key = key
+	params.UploadId = uploadID
+	params.PartNumber = num
+	params.CopySourceBucket = s.bucket
+	params.CopySourceKey = src
+	params.CopySourceRangeStart = off
+	params.CopySourceRangeEnd = off + size - 1
+	output, err := s.c.CopyPart(params)
+	if err != nil {
+		klog.Errorf("UploadPartCopy OBS %v from %v error %v", key, src, err)
+		return nil, err
+	}
+	return &backend.Part{
+		Num:  num,
+		Size: int(size),
+		ETag: output.ETag,
+	}, nil
+}
+
 func (s *obsClient) AbortUpload(key string, uploadID string) error {
 	params := &obs.AbortMultipartUploadInput{}
 	params.Bucket = s.bucket
@@ -0,0 +1,128 @@
+package obs
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+)
+
+// fakeCopyServer answers the OBS calls of Copy for one source object of the
+// given size and records the copy requests it gets.
+type fakeCopyServer struct {
+	sync.Mutex
+	size  int64
+	calls []string
+}
+
+// header returns the value of the header with the given suffix, OBS and
+// S3 signatures name them differently.
+func header(r *http.Request, suffix string) string {
+	for k, v := range r.Header {
+		if strings.HasSuffix(strings.ToLower(k), suffix) {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func (s *fakeCopyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	switch {
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", strconv.FormatInt(s.size, 10))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("x-obs-meta-k", "v")
+	case r.Method == http.MethodPost && uploads:
+		s.calls = append(s.calls, "create")
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>u</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodGet:
+		s.calls = append(s.calls, "get "+r.Header.Get("Range"))
+		fmt.Fprint(w, "xy")
+	case r.Method == http.MethodPut && q.Get("uploadId") == "u" && header(r, "-copy-source") == "":
+		s.calls = append(s.calls, "part "+q.Get("partNumber")+" upload")
+		w.Header().Set("ETag", `"p"`)
+	case r.Method == http.MethodPut && q.Get("uploadId") == "u":
+		s.calls = append(s.calls, "part "+q.Get("partNumber")+" "+header(r, "-copy-source-range"))
+		fmt.Fprintf(w, `<CopyPartResult><ETag>"p%s"</ETag></CopyPartResult>`, q.Get("partNumber"))
+	case r.Method == http.MethodPut:
+		call := "copy " + header(r, "-copy-source")
+		if d := header(r, "-metadata-directive"); d != "" {
+			call += " " + d + " " + header(r, "-meta-k")
+		}
+		s.calls = append(s.calls, call)
+		fmt.Fprint(w, `<CopyObjectResult><ETag>"e"</ETag></CopyObjectResult>`)
+	case r.Method == http.MethodPost && q.Get("uploadId") == "u":
+		s.calls = append(s.calls, "complete")
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"c"</ETag></CompleteMultipartUploadResult>`)
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	large := int64(backend.MaxCopySize + 1)
+	for _, c := range []struct {
+		size int64
+		dst  string
+		want []string
+	}{
+		{10, "c", []string{"copy b/a"}},
+		// a copy onto itself keeps the metadata
+		{10, "a", []string{"copy b/a REPLACE v"}},
+		{large, "c", []string{
+			"create",
+			fmt.Sprintf("part 1 bytes=0-%d", backend.CopyPartSize-1),
+			fmt.Sprintf("part 2 bytes=%d-%d", backend.CopyPartSize, 2*backend.CopyPartSize-1),
+			fmt.Sprintf("part 3 bytes=%d-%d", 2*backend.CopyPartSize, 3*backend.CopyPartSize-1),
+			fmt.Sprintf("part 4 bytes=%d-%d", 3*backend.CopyPartSize, 4*backend.CopyPartSize-1),
+			fmt.Sprintf("part 5 bytes=%d-%d", 4*backend.CopyPartSize, 5*backend.CopyPartSize-1),
+			// a range of one byte is not sent as a copy
+			fmt.Sprintf("get bytes=%d-%d", 5*backend.CopyPartSize, large),
+			"part 6 upload",
+			"complete",
+		}},
+	} {
+		fake := &fakeCopyServer{size: c.size}
+		srv := httptest.NewServer(fake)
+		s, err := NewObsClient("b", "r", "ak", "sk", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Copy("a", c.dst); err != nil {
+			t.Fatalf("Copy of %d bytes: %v", c.size, err)
+		}
+		srv.Close()
+		if !reflect.DeepEqual(fake.calls, c.want) {
+			t.Errorf("Copy of %d bytes made calls %q, want %q", c.size, fake.calls, c.want)
+		}
+	}
+}
+
+func TestGetOneByte(t *testing.T) {
+	fake := &fakeCopyServer{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	s, err := NewObsClient("b", "r", "ak", "sk", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	n, err := s.Get("a", 5, 1, buf)
+	if err != nil || string(buf[:n]) != "x" {
+		t.Fatalf("Get of one byte = %q, %v", buf[:n], err)
+	}
+	if want := []string{"get bytes=5-6"}; !reflect.DeepEqual(fake.calls, want) {
+		t.Fatalf("Get of one byte made calls %q, want %q", fake.calls, want)
+	}
+}
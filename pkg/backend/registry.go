@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// Factory creates an ObjectStorage from a parsed backend spec.
+type Factory func(u *url.URL) (ObjectStorage, error)
+
+var (
+	mu        sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a backend available under the URL scheme name. It is
+// meant to be called from the init function of the backend package.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("backend %s registered twice", name))
+	}
+	factories[name] = f
+}
+
+// Backends returns the names of all registered backends.
+func Backends() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the backend described by spec, such as
+// s3://bucket?region=r&endpoint=e, obs://bucket or file:///path.
+func New(spec string) (ObjectStorage, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		// spec may hold credentials, it is left out
+		if e, ok := err.(*url.Error); ok {
+			err = e.Err
+		}
+		return nil, fmt.Errorf("invalid backend: %v", err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("invalid backend %q: missing scheme, one of %v", u.Redacted(), Backends())
+	}
+	mu.Lock()
+	f, ok := factories[u.Scheme]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %s, one of %v", u.Scheme, Backends())
+	}
+	return f(u)
+}
+
+// Credentials returns the access and secret key from the user info of u.
+func Credentials(u *url.URL) (ak, sk string) {
+	if u.User == nil {
+		return "", ""
+	}
+	sk, _ = u.User.Password()
+	return u.User.Username(), sk
+}
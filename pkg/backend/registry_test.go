@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type nameStorage struct {
+	ObjectStorage
+	name string
+}
+
+func TestRegistry(t *testing.T) {
+	Register("test", func(u *url.URL) (ObjectStorage, error) {
+		ak, sk := Credentials(u)
+		return &nameStorage{name: u.Host + u.Path + "," + u.Query().Get("region") + "," + ak + ":" + sk}, nil
+	})
+	s, err := New("test://ak:sk@bucket/dir?region=r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.(*nameStorage).name; got != "bucket/dir,r,ak:sk" {
+		t.Fatalf("factory got %q", got)
+	}
+	found := false
+	for _, name := range Backends() {
+		found = found || name == "test"
+	}
+	if !found {
+		t.Fatalf("Backends() = %v, misses test", Backends())
+	}
+
+	for _, spec := range []string{"bucket", "unknown://bucket", "test://%zz"} {
+		if _, err := New(spec); err == nil {
+			t.Errorf("New(%q) succeeded", spec)
+		}
+	}
+	if _, err := New("unknown://bucket"); err == nil || !strings.Contains(err.Error(), "test") {
+		t.Errorf("New of an unknown backend = %v, should list the known ones", err)
+	}
+	// the secret key is not shown in errors
+	for _, spec := range []string{"test://ak:secret@%zz", "//ak:secret@bucket"} {
+		if _, err := New(spec); err == nil || strings.Contains(err.Error(), "secret") {
+			t.Errorf("New(%q) = %v", spec, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering test twice did not panic")
+		}
+	}()
+	Register("test", nil)
+}
+
+func TestCredentials(t *testing.T) {
+	u, _ := url.Parse("s3://bucket")
+	if ak, sk := Credentials(u); ak != "" || sk != "" {
+		t.Fatalf("Credentials without user info = %q, %q", ak, sk)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -15,6 +16,14 @@ import (
 	"k8s.io/klog/v2"
 )
 
+func init() {
+	backend.Register("s3", func(u *url.URL) (backend.ObjectStorage, error) {
+		ak, sk := backend.Credentials(u)
+		q := u.Query()
+		return NewS3Client(u.Host, q.Get("region"), ak, sk, q.Get("endpoint"))
+	})
+}
+
 type s3Client struct {
 	bucket  string
 	s3      *s3.S3
@@ -147,6 +156,60 @@ func (s *s3Client) PutDirectory(key string) error {
 	return err
 }
 
+func (s *s3Client) Copy(src, dst string) error {
+	o, err := s.Head(src)
+	if err != nil {
+		return err
+	}
+	source := (&url.URL{Path: s.bucket + "/" + src}).EscapedPath()
+	m := make(map[string]*string)
+	for k, v := range o.Metadata {
+		v := v
+		m[k] = &v
+	}
+	if o.Size <= backend.MaxCopySize {
+		params := &s3.CopyObjectInput{}
+		params.Bucket = &s.bucket
+		params.Key = &dst
+		params.CopySource = &source
+		if src == dst {
+			// A copy onto itself only refreshes the mtime, S3 takes it
+			// when the metadata is replaced.
+			params.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+			params.Metadata = m
+		}
+		if _, err := s.s3.CopyObject(params); err != nil {
+			klog.Errorf("Copy S3 %v to %v Object error %v", src, dst, err)
+			return err
+		}
+		return nil
+	}
+
+	input := &s3.CreateMultipartUploadInput{}
+	input.Bucket = &s.bucket
+	input.Key = &dst
+	input.Metadata = m
+	output, err := s.s3.CreateMultipartUpload(input)
+	if err != nil {
+		klog.Errorf("Copy S3 %v to %v Object error %v", src, dst, err)
+		return err
+	}
+	var parts []*backend.Part
+	for off, num := int64(0), 1; off < o.Size; off, num = off+backend.CopyPartSize, num+1 {
+		end := off + backend.CopyPartSize
+		if end > o.Size {
+			end = o.Size
+		}
+		part, err := s.UploadPartCopy(dst, *output.UploadId, num, src, off, end-off)
+		if err != nil {
+			s.AbortUpload(dst, *output.UploadId)
+			return err
+		}
+		parts = append(parts, part)
+	}
+	return s.CompleteUpload(dst, *output.UploadId, parts)
+}
+
 func (s *s3Client) Delete(key string) error {
 	params := &s3.DeleteObjectInput{}
 	params.Bucket = &s.bucket
@@ -241,6 +304,29 @@ func (s *s3Client) UploadPart(key string, uploadID string, num int, body []byte)
 	}, nil
 }
 
+func (s *s3Client) UploadPartCopy(key string, uploadID string, num int, src string, off, size int64) (*backend.Part, error) {
+	source := (&url.URL{Path: s.bucket + "/" + src}).EscapedPath()
+	r := fmt.Sprintf("bytes=%d-%d", off, off+size-1)
+	n := int64(num)
+	params := &s3.UploadPartCopyInput{}
+	params.Bucket = &s.bucket
+	params.Key = &key
+	params.UploadId = &uploadID
+	params.PartNumber = &n
+	params.CopySource = &source
+	params.CopySourceRange = &r
+	output, err := s.s3.UploadPartCopy(params)
+	if err != nil {
+		klog.Errorf("UploadPartCopy S3 %v from %v error %v", key, src, err)
+		return nil, err
+	}
+	return &backend.Part{
+		Num:  num,
+		Size: int(size),
+		ETag: *output.CopyPartResult.ETag,
+	}, nil
+}
+
 func (s *s3Client) AbortUpload(key string, uploadID string) error {
 	params := &s3.AbortMultipartUploadInput{}
 	params.Bucket = &s.bucket
@@ -0,0 +1,90 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+)
+
+// fakeCopyServer answers the S3 calls of Copy for one source object of the
+// given size and records the copy requests it gets.
+type fakeCopyServer struct {
+	sync.Mutex
+	size  int64
+	calls []string
+}
+
+func (s *fakeCopyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	switch {
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", strconv.FormatInt(s.size, 10))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("x-amz-meta-k", "v")
+	case r.Method == http.MethodPost && uploads:
+		s.calls = append(s.calls, "create "+r.Header.Get("x-amz-meta-k"))
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>u</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && q.Get("uploadId") == "u":
+		s.calls = append(s.calls, "part "+q.Get("partNumber")+" "+r.Header.Get("x-amz-copy-source-range"))
+		fmt.Fprintf(w, `<CopyPartResult><ETag>"p%s"</ETag></CopyPartResult>`, q.Get("partNumber"))
+	case r.Method == http.MethodPut:
+		call := "copy " + r.Header.Get("x-amz-copy-source")
+		if d := r.Header.Get("x-amz-metadata-directive"); d != "" {
+			call += " " + d + " " + r.Header.Get("x-amz-meta-k")
+		}
+		s.calls = append(s.calls, call)
+		fmt.Fprint(w, `<CopyObjectResult><ETag>"e"</ETag></CopyObjectResult>`)
+	case r.Method == http.MethodPost && q.Get("uploadId") == "u":
+		s.calls = append(s.calls, "complete")
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"c"</ETag></CompleteMultipartUploadResult>`)
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	large := int64(backend.MaxCopySize + 1)
+	for _, c := range []struct {
+		size int64
+		dst  string
+		want []string
+	}{
+		{10, "c", []string{"copy b/a%20b"}},
+		// a copy onto itself keeps the metadata
+		{10, "a b", []string{"copy b/a%20b REPLACE v"}},
+		{large, "c", []string{
+			"create v",
+			fmt.Sprintf("part 1 bytes=0-%d", backend.CopyPartSize-1),
+			fmt.Sprintf("part 2 bytes=%d-%d", backend.CopyPartSize, 2*backend.CopyPartSize-1),
+			fmt.Sprintf("part 3 bytes=%d-%d", 2*backend.CopyPartSize, 3*backend.CopyPartSize-1),
+			fmt.Sprintf("part 4 bytes=%d-%d", 3*backend.CopyPartSize, 4*backend.CopyPartSize-1),
+			fmt.Sprintf("part 5 bytes=%d-%d", 4*backend.CopyPartSize, 5*backend.CopyPartSize-1),
+			fmt.Sprintf("part 6 bytes=%d-%d", 5*backend.CopyPartSize, large-1),
+			"complete",
+		}},
+	} {
+		fake := &fakeCopyServer{size: c.size}
+		srv := httptest.NewServer(fake)
+		s, err := NewS3Client("b", "us-east-1", "ak", "sk", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Copy("a b", c.dst); err != nil {
+			t.Fatalf("Copy of %d bytes: %v", c.size, err)
+		}
+		srv.Close()
+		if !reflect.DeepEqual(fake.calls, c.want) {
+			t.Errorf("Copy of %d bytes made calls %q, want %q", c.size, fake.calls, c.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package fuse
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	// CacheBlockSize is the unit of data kept by the block cache.
+	CacheBlockSize = 1 << 22
+	// BlockCacheSize is the default memory of the block cache.
+	BlockCacheSize = 1 << 29
+)
+
+// blockKey names a block of the block cache. The blocks of a chunk are
+// named by its hash, so they stay valid whichever file reads them, those of
+// a plain object by its key and the version of the data stored there.
+type blockKey struct {
+	key     string
+	version string
+	hash    string
+	index   int64
+}
+
+type block struct {
+	key  blockKey
+	data []byte
+}
+
+// blockCache keeps the data read by all open files in memory and evicts the
+// least recently used blocks when it is full.
+type blockCache struct {
+	sync.Mutex
+	used   int64
+	limit  int64
+	lru    *list.List
+	blocks map[blockKey]*list.Element
+	// gen counts the invalidations, data fetched across one of them is
+	// not cached.
+	gen uint64
+}
+
+func newBlockCache(limit int64) *blockCache {
+	return &blockCache{
+		limit:  limit,
+		lru:    list.New(),
+		blocks: make(map[blockKey]*list.Element),
+	}
+}
+
+// read fills buf with the data at off of the object or chunk k names, off
+// is a multiple of CacheBlockSize. Unless all of its blocks are cached the
+// data is fetched as a whole and then cached.
+func (c *blockCache) read(k blockKey, off int64, buf []byte, fetch func(buf []byte) error) error {
+	gen, ok := c.get(k, off, buf)
+	if ok {
+		return nil
+	}
+	if err := fetch(buf); err != nil {
+		return err
+	}
+	c.put(k, gen, off, buf)
+	return nil
+}
+
+func (c *blockCache) get(k blockKey, off int64, buf []byte) (uint64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	gen := c.gen
+	var els []*list.Element
+	for pos := int64(0); pos < int64(len(buf)); pos += CacheBlockSize {
+		k.index = (off + pos) / CacheBlockSize
+		el := c.blocks[k]
+		if el == nil || len(el.Value.(*block).data) < c.blockLen(buf, pos) {
+			return gen, false
+		}
+		els = append(els, el)
+	}
+	for i, el := range els {
+		copy(buf[int64(i)*CacheBlockSize:], el.Value.(*block).data)
+		c.lru.MoveToFront(el)
+	}
+	return gen, true
+}
+
+func (c *blockCache) blockLen(buf []byte, pos int64) int {
+	if n := int64(len(buf)) - pos; n < CacheBlockSize {
+		return int(n)
+	}
+	return CacheBlockSize
+}
+
+func (c *blockCache) put(k blockKey, gen uint64, off int64, buf []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if c.gen != gen {
+		return
+	}
+	for pos := int64(0); pos < int64(len(buf)); pos += CacheBlockSize {
+		k.index = (off + pos) / CacheBlockSize
+		data := append([]byte(nil), buf[pos:pos+int64(c.blockLen(buf, pos))]...)
+		if el := c.blocks[k]; el != nil {
+			c.remove(el)
+		}
+		c.blocks[k] = c.lru.PushFront(&block{key: k, data: data})
+		c.used += int64(len(data))
+	}
+	for c.used > c.limit && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *blockCache) remove(el *list.Element) {
+	b := c.lru.Remove(el).(*block)
+	delete(c.blocks, b.key)
+	c.used -= int64(len(b.data))
+}
+
+// invalidate drops the cached data of the object key, its data changed.
+func (fs *FileSystem) invalidate(key string) {
+	fs.blocks.invalidate(key)
+	fs.disk.invalidate(key)
+}
+
+// invalidate drops the blocks of the object key, its data changed.
+func (c *blockCache) invalidate(key string) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	for k, el := range c.blocks {
+		if k.key == key {
+			c.remove(el)
+		}
+	}
+}
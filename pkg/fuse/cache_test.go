@@ -0,0 +1,121 @@
+package fuse
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+// cacheRead reads size bytes of k at off through c and reports whether they
+// were fetched.
+func cacheRead(t *testing.T, c *blockCache, k blockKey, off int64, size int, fill byte) ([]byte, bool) {
+	t.Helper()
+	fetched := false
+	buf := make([]byte, size)
+	err := c.read(k, off, buf, func(buf []byte) error {
+		fetched = true
+		for i := range buf {
+			buf[i] = fill
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf, fetched
+}
+
+func TestBlockCache(t *testing.T) {
+	c := newBlockCache(3 * CacheBlockSize)
+	k := blockKey{key: "a", version: "1"}
+	if _, fetched := cacheRead(t, c, k, 0, 2*CacheBlockSize, 1); !fetched {
+		t.Fatalf("empty cache did not fetch")
+	}
+	if buf, fetched := cacheRead(t, c, k, 0, 2*CacheBlockSize, 2); fetched || buf[0] != 1 {
+		t.Fatalf("cached blocks were fetched again")
+	}
+	// a part of the cached blocks is enough
+	if _, fetched := cacheRead(t, c, k, CacheBlockSize, 100, 2); fetched {
+		t.Fatalf("cached block was fetched again")
+	}
+	// another version of the object is not served from the cache
+	if buf, fetched := cacheRead(t, c, blockKey{key: "a", version: "2"}, 0, 100, 3); !fetched || buf[0] != 3 {
+		t.Fatalf("other version was read from the cache")
+	}
+
+	// the least recently used block goes first
+	cacheRead(t, c, k, 0, 100, 0)
+	cacheRead(t, c, blockKey{hash: "h"}, 0, CacheBlockSize, 4)
+	if c.used > c.limit {
+		t.Fatalf("cache holds %d bytes over its limit %d", c.used, c.limit)
+	}
+	if _, fetched := cacheRead(t, c, k, CacheBlockSize, 100, 5); !fetched {
+		t.Fatalf("least recently used block was kept")
+	}
+
+	c.invalidate("a")
+	for key := range c.blocks {
+		if key.key == "a" {
+			t.Fatalf("invalidated block %+v kept", key)
+		}
+	}
+	// data fetched across an invalidation is not cached
+	buf := make([]byte, 100)
+	c.read(k, 0, buf, func(buf []byte) error {
+		c.invalidate("a")
+		return nil
+	})
+	if _, fetched := cacheRead(t, c, k, 0, 100, 6); !fetched {
+		t.Fatalf("data fetched across an invalidation was cached")
+	}
+
+	failed := errors.New("failed")
+	if err := c.read(blockKey{key: "b"}, 0, buf, func([]byte) error { return failed }); err != failed {
+		t.Fatalf("read = %v, want the fetch error", err)
+	}
+	if _, fetched := cacheRead(t, c, blockKey{key: "b"}, 0, 100, 7); !fetched {
+		t.Fatalf("failed fetch was cached")
+	}
+}
+
+func TestBlockCacheObjectChanged(t *testing.T) {
+	store := mem.NewMemClient("t")
+	fs := mountTest(t, store, t.TempDir(), false, true, "")
+	data := testData(5000, 21)
+	f := writeFile(t, rootDir(fs), "f", data)
+	if !bytes.Equal(readFile(t, f), data) {
+		t.Fatalf("read back wrong data")
+	}
+
+	// another client rewrites the object
+	time.Sleep(time.Millisecond)
+	changed := testData(5000, 22)
+	if err := store.Put("f", nil, bytes.NewReader(changed)); err != nil {
+		t.Fatal(err)
+	}
+	h := openTest(t, f, fuse.OpenReadOnly)
+	defer releaseTest(t, h)
+	if got := readTest(t, h, 0, len(changed)); !bytes.Equal(got, changed) {
+		t.Fatalf("read the cached blocks of the replaced object")
+	}
+}
+
+func TestBlockCacheSharedChunks(t *testing.T) {
+	store := mem.NewMemClient("t")
+	fs := mountTest(t, store, t.TempDir(), true, true, "")
+	data := testData(2*ChunkCacheFixedSize, 23)
+	writeFile(t, rootDir(fs), "a", data)
+	b := writeFile(t, rootDir(fs), "b", data)
+	readFile(t, lookupTest(t, rootDir(fs), "a").(*File))
+
+	// the chunks of b were cached by reading a
+	store.SetFaults(mem.Faults{TruncateGet: 1})
+	defer store.SetFaults(mem.Faults{})
+	if !bytes.Equal(readFile(t, b), data) {
+		t.Fatalf("read of shared chunks went to the bucket")
+	}
+}
@@ -1,25 +1,31 @@
 package fuse
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
-	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 
-	"github.com/nevermore/muyifs/pkg/compress/lz4"
-	"github.com/nevermore/muyifs/pkg/compress/snappy"
+	"github.com/nevermore/muyifs/pkg/meta"
 	"github.com/restic/chunker"
 	"k8s.io/klog/v2"
-
-	"github.com/nevermore/muyifs/pkg/compress/zstd"
 )
 
 type ChunkWriter struct {
-	key      string
-	index    int
+	ino   uint64
+	key   string
+	index int
+	// saved is false while uploaded chunks are missing from the layout.
+	saved    bool
+	uploader *chunkUploader
+	// replaced are the stored chunks the writer writes again.
+	replaced []ChunkMeta
+	// codec names compress in the manifest.
+	codec    string
 	compress Compress
 	*ChunkCache
 	fs         *FileSystem
@@ -30,6 +36,9 @@ type ChunkCache struct {
 	isError  bool
 	isFixed  bool
 	pol      chunker.Pol
+	minSize  uint
+	maxSize  uint
+	avgBits  int
 	chnker   *chunker.Chunker
 	chunkBuf []byte
 	offset   int64
@@ -48,12 +57,20 @@ const (
 	ChunkCacheDynamicReadSize = 1 << 24
 
 	MetaKey = "chunkid"
+
+	// reservedPrefix holds the objects of the file system itself, no file
+	// or directory of the mount may use it.
+	reservedPrefix = ".muyifs/"
+	// chunkPrefix is where the chunks of all files are stored.
+	chunkPrefix = reservedPrefix + "chunks/"
 )
 
-func NewChunkWriter(key string, fs *FileSystem, compress string, isFixed bool) CommonWriter {
+func NewChunkWriter(ino uint64, key string, fs *FileSystem, compress string, isFixed bool) CommonWriter {
 	c := &ChunkWriter{
+		ino:   ino,
 		key:   key,
 		index: 0,
+		saved: true,
 		fs:    fs,
 	}
 	c.ChunkCache = &ChunkCache{
@@ -62,34 +79,106 @@ func NewChunkWriter(key string, fs *FileSystem, compress string, isFixed bool) C
 		offset:  0,
 		length:  0,
 	}
-	if isFixed {
-		c.ChunkCache.chunkBuf = make([]byte, ChunkCacheFixedSize, ChunkCacheFixedSize)
-	} else {
-		c.ChunkCache.chunkBuf = make([]byte, ChunkCacheDynamicSize, ChunkCacheDynamicSize)
-		c.ChunkCache.pol = chunker.Pol(0x3DA3358B4DC173)
-		c.ChunkCache.chnker = chunker.New(nil, chunker.Pol(0x3DA3358B4DC173))
-	}
+	c.setChunking(isFixed, chunkerPol, chunkerMinSize, chunkerMaxSize, chunkerAvgBits)
 	c.ChunkMetas = append(c.ChunkMetas, ChunkMeta{
 		Index:        0,
 		Start:        0,
 		End:          0,
 		CompressSize: 0,
 	})
-	if compress != "" {
-		c.compress = Compress{
-			Enable:   true,
-			Compress: &zstd.ZStandard{},
+	c.codec = codecName(compress)
+	c.compress = newCompress(c.codec)
+	return c
+}
+
+func (c *ChunkWriter) setChunking(isFixed bool, pol chunker.Pol, minSize, maxSize uint, avgBits int) {
+	c.isFixed = isFixed
+	if isFixed {
+		c.chunkBuf = make([]byte, ChunkCacheFixedSize, ChunkCacheFixedSize)
+		c.chnker = nil
+		return
+	}
+	c.chunkBuf = make([]byte, ChunkCacheDynamicSize, ChunkCacheDynamicSize)
+	c.pol, c.minSize, c.maxSize, c.avgBits = pol, minSize, maxSize, avgBits
+	c.chnker = chunker.New(nil, pol)
+}
+
+// configure makes the writer store chunks the way the manifest m says, so
+// that a file keeps the settings it was written with.
+func (c *ChunkWriter) configure(m *Manifest) {
+	if m.Version == 0 {
+		return
+	}
+	c.codec = m.Codec
+	c.compress = newCompress(m.Codec)
+	if m.Fixed != c.isFixed || (!m.Fixed && (m.Pol != c.pol || m.MinSize != c.minSize || m.MaxSize != c.maxSize || m.AvgBits != c.avgBits)) {
+		c.setChunking(m.Fixed, m.Pol, m.MinSize, m.MaxSize, m.AvgBits)
+	}
+}
+
+// manifest returns the manifest of the chunks metas stored by the writer.
+func (c *ChunkWriter) manifest(metas []ChunkMeta) *Manifest {
+	m := &Manifest{
+		Version: manifestVersion,
+		Codec:   c.codec,
+		Fixed:   c.isFixed,
+		Chunks:  metas,
+	}
+	if c.isFixed {
+		m.ChunkSize = ChunkCacheFixedSize
+	} else {
+		m.Pol, m.MinSize, m.MaxSize, m.AvgBits = c.pol, c.minSize, c.maxSize, c.avgBits
+	}
+	for _, cm := range metas {
+		if cm.End > m.Size {
+			m.Size = cm.End
 		}
-		switch compress {
-		case "zstd":
-			c.compress.Compress = &zstd.ZStandard{}
-		case "lz4":
-			c.compress.Compress = &lz4.LZ4{}
-		case "snappy":
-			c.compress.Compress = &snappy.Snappy{}
+	}
+	return m
+}
+
+// appendTo makes the writer continue the stored chunk layout of a file of
+// size bytes, the next write is expected at size.
+func (c *ChunkWriter) appendTo(size int64) error {
+	if size == 0 {
+		return nil
+	}
+	manifest, err := c.fs.loadManifest(c.ino, c.key)
+	if err != nil {
+		return err
+	}
+	c.configure(manifest)
+	var metas []ChunkMeta
+	for _, m := range manifest.Chunks {
+		if m.Start < m.End {
+			metas = append(metas, m)
 		}
 	}
-	return c
+	n := len(metas)
+	if n == 0 || metas[n-1].End != size {
+		return fmt.Errorf("chunk layout of %v does not end at %d", c.key, size)
+	}
+	c.index = n
+	c.offset = size
+	// A short last chunk is loaded back into the buffer and grows, so that
+	// only the last chunk of a file is ever shorter than a full one.
+	if last := metas[n-1]; last.End-last.Start < ChunkCacheFixedSize {
+		r := NewChunkReader(c.ino, c.key, c.fs, c.fs.compress, c.isFixed).(*ChunkReader)
+		r.configure(manifest)
+		r.ChunkMetas = manifest.Chunks
+		if err := r.doDownload(last.Index, c.chunkBuf); err != nil {
+			return err
+		}
+		c.index = last.Index
+		c.length = last.End - last.Start
+		c.replaced = append(c.replaced, last)
+		metas = metas[:n-1]
+	}
+	c.ChunkMetas = append(metas, ChunkMeta{
+		Index: c.index,
+		Start: c.offset - c.length,
+	})
+	return nil
 }
 
 func (c *ChunkWriter) doFixedJob(buf []byte) error {
@@ -174,8 +263,28 @@ func (c *ChunkWriter) WriteAt(p []byte, off int64) (n int, err error) {
 	return len(p), nil
 }
 
-func (c *ChunkWriter) uploadKey() string {
-	return c.key + "/" + strconv.Itoa(c.index)
+// chunkObject returns the object key of the chunk m of the file key. Chunks
+// are stored by their hash and shared by all files, chunks stored before
+// that are kept at <key>/<index>.
+func chunkObject(key string, m ChunkMeta) string {
+	if m.Hash != "" {
+		return chunkPrefix + m.Hash
+	}
+	return key + "/" + strconv.Itoa(m.Index)
+}
+
+// dropChunks deletes the chunks of the file key that its layout no longer
+// uses. Shared chunks may be used by files of any mount of the bucket, they
+// are left to gc.
+func (fs *FileSystem) dropChunks(key string, metas []ChunkMeta) {
+	for _, m := range metas {
+		if m.Hole || m.Hash != "" {
+			continue
+		}
+		if err := fs.Backend.Delete(chunkObject(key, m)); err != nil {
+			klog.Errorf("Delete chunk %v error %v", chunkObject(key, m), err)
+		}
+	}
 }
 
 func (c *ChunkWriter) hash(data []byte) ID {
@@ -200,8 +309,8 @@ func (c *ChunkWriter) doCompress(buf []byte) ([]byte, error) {
 	return tmpBuf[:n], nil
 }
 
-func (c *ChunkWriter) checkDuplicate(id ID) bool {
-	o, err := c.fs.Backend.Head(c.uploadKey())
+func (c *ChunkWriter) checkDuplicate(key string, id ID) bool {
+	o, err := c.fs.Backend.Head(key)
 	if err != nil {
 		klog.Errorf("Head error %v", err)
 		return false
@@ -216,36 +325,61 @@ func (c *ChunkWriter) checkDuplicate(id ID) bool {
 	return false
 }
 
-func (c *ChunkWriter) doFixedUpload() error {
-
-	var reader *bytes.Reader
-	var id ID
-	compressSize := int64(len(c.chunkBuf))
-
+// putChunk compresses and uploads data as a chunk named by its hash, unless
+// a chunk with the same data is stored already. It returns the size and the
+// hash of the stored chunk.
+func (c *ChunkWriter) putChunk(data []byte) (int64, ID, error) {
 	if c.compress.Enable {
-		data, err := c.doCompress(c.chunkBuf)
-		if err != nil {
-			return err
+		var err error
+		if data, err = c.doCompress(data); err != nil {
+			return 0, ID{}, err
 		}
-		compressSize = int64(len(data))
-		reader = bytes.NewReader(data)
-		id = c.hash(data)
-	} else {
-		reader = bytes.NewReader(c.chunkBuf)
-		id = c.hash(c.chunkBuf)
 	}
+	id := c.hash(data)
+	key := chunkPrefix + id.String()
+	if !c.checkDuplicate(key, id) || !c.touch(key) {
+		if err := c.fs.Backend.Put(key, map[string]string{MetaKey: id.String()}, bytes.NewReader(data)); err != nil {
+			return 0, ID{}, err
+		}
+	}
+	return int64(len(data)), id, nil
+}
 
-	if !c.checkDuplicate(id) {
-		err := c.fs.Backend.Put(c.uploadKey(), map[string]string{MetaKey: id.String()}, reader)
-		if err != nil {
-			c.isError = true
-			klog.Errorf("Do upload job error %v", err)
-			return err
+// touch copies the stored chunk key onto itself, so that gc sees it stored
+// now and keeps it for the grace period. It fails when gc deleted the chunk
+// since it was found.
+func (c *ChunkWriter) touch(key string) bool {
+	if err := c.fs.Backend.Copy(key, key); err != nil {
+		klog.Errorf("Touch chunk %v error %v", key, err)
+		return false
+	}
+	return true
+}
+
+// upload returns the uploader of the writer, chunks are compressed, hashed
+// and uploaded in the background while the next ones are filled.
+func (c *ChunkWriter) upload() *chunkUploader {
+	if c.uploader == nil {
+		size := ChunkCacheFixedSize
+		if !c.isFixed {
+			size = int(c.maxSize)
 		}
+		c.uploader = newChunkUploader(c, size)
 	}
+	return c.uploader
+}
+
+func (c *ChunkWriter) doFixedUpload() error {
+	u := c.upload()
+	if err := u.error(); err != nil {
+		c.isError = true
+		klog.Errorf("Do upload job error %v", err)
+		return err
+	}
+	u.upload(c.index, c.chunkBuf[:c.length])
+	c.chunkBuf = u.buffer()
 
 	c.ChunkMetas[c.index].End = c.offset
-	c.ChunkMetas[c.index].CompressSize = compressSize
 	c.index++
 	c.ChunkMetas = append(c.ChunkMetas, ChunkMeta{
 		Index:        c.index,
@@ -254,24 +388,27 @@ func (c *ChunkWriter) doFixedUpload() error {
 		CompressSize: 0,
 	})
 	c.length = 0
+	c.saved = false
 
 	return nil
 }
 
 func (c *ChunkWriter) doDynamicUpload() error {
-
-	var id ID
-	var reader *bytes.Reader
-
-	tmpBuf := make([]byte, 1<<23)
+	u := c.upload()
 	rd := bytes.NewReader(c.chunkBuf[:c.length])
-	c.chnker.ResetWithBoundaries(rd, c.pol, 1<<22, ChunkCacheDynamicReadSize)
-	c.chnker.SetAverageBits(23)
+	c.chnker.ResetWithBoundaries(rd, c.pol, c.minSize, c.maxSize)
+	c.chnker.SetAverageBits(c.avgBits)
 	tmpOff := c.offset - c.length
 
 	for {
-		chunk, err := c.chnker.Next(tmpBuf)
+		if err := u.error(); err != nil {
+			c.isError = true
+			return err
+		}
+		buf := u.buffer()
+		chunk, err := c.chnker.Next(buf)
 		if err != nil {
+			u.release(buf)
 			if err == io.EOF {
 				break
 			} else {
@@ -279,29 +416,9 @@ func (c *ChunkWriter) doDynamicUpload() error {
 			}
 		}
 		tmpOff += int64(chunk.Length)
-		compressSize := int64(len(chunk.Data))
-
-		if c.compress.Enable {
-			data, err := c.doCompress(chunk.Data)
-			if err != nil {
-				return err
-			}
-			compressSize = int64(len(data))
-			reader = bytes.NewReader(data)
-			id = c.hash(data)
-		} else {
-			reader = bytes.NewReader(chunk.Data)
-			id = c.hash(chunk.Data)
-		}
-
-		if !c.checkDuplicate(id) {
-			if err := c.fs.Backend.Put(c.uploadKey(), map[string]string{MetaKey: id.String()}, reader); err != nil {
-				return err
-			}
-		}
+		u.upload(c.index, chunk.Data)
 
 		c.ChunkMetas[c.index].End = tmpOff
-		c.ChunkMetas[c.index].CompressSize = compressSize
 		c.index++
 		c.ChunkMetas = append(c.ChunkMetas, ChunkMeta{
 			Index: c.index,
@@ -310,6 +427,26 @@ func (c *ChunkWriter) doDynamicUpload() error {
 		})
 	}
 	c.length = 0
+	c.saved = false
+	return nil
+}
+
+// wait waits for the chunks in flight and records their stored sizes and
+// hashes.
+func (c *ChunkWriter) wait() error {
+	if c.uploader == nil {
+		return nil
+	}
+	stored, err := c.uploader.wait()
+	c.uploader = nil
+	if err != nil {
+		c.isError = true
+		return err
+	}
+	for index, m := range stored {
+		c.ChunkMetas[index].CompressSize = m.CompressSize
+		c.ChunkMetas[index].Hash = m.Hash
+	}
 	return nil
 }
 
@@ -319,13 +456,14 @@ func (c *ChunkWriter) Flush() error {
 		return fmt.Errorf("upload is in error state")
 	}
 
-	if c.length == 0 && len(c.extras) == 0 {
+	if c.length == 0 && len(c.extras) == 0 && c.saved {
 		return nil
 	}
 
 	for i := 0; i < len(c.extras); {
 		if c.extras[i].off == c.offset {
 			if err := c.dispatchJob(c.extras[i].buffer); err != nil {
+				c.wait()
 				return err
 			}
 			c.extras = append(c.extras[:i], c.extras[i+1:]...)
@@ -338,18 +476,87 @@ func (c *ChunkWriter) Flush() error {
 	if c.length > 0 {
 		err := c.dispatchUpload()
 		if err != nil {
+			c.wait()
 			return fmt.Errorf("upload is in error state")
 		}
 	}
 
-	b, err := json.Marshal(c.ChunkMetas)
+	// The layout is only stored once all of its chunks are.
+	if err := c.wait(); err != nil {
+		klog.Errorf("Upload chunks of %v error %v", c.key, err)
+		return err
+	}
+	if err := c.putLayout(c.ChunkMetas); err != nil {
+		return err
+	}
+	c.saved = true
+	c.fs.dropChunks(c.key, c.replaced)
+	c.replaced = nil
+	return nil
+}
+
+// putLayout stores the manifest of the chunk layout in <key>/.meta and in
+// the inode. The pages of the manifest are stored first, those the inode
+// already references are kept as they are and the others are deleted once
+// .meta no longer references them.
+func (c *ChunkWriter) putLayout(metas []ChunkMeta) error {
+	m := c.manifest(metas)
+	pages, err := encodeManifest(m)
 	if err != nil {
-		return fmt.Errorf("json marshal failed %v", err)
+		return err
 	}
-	return c.fs.Backend.Put(c.key+"/.meta", map[string]string{"aa": "bb"}, bytes.NewReader(b))
+	old := c.fs.storedPages(c.ino)
+	for i, hash := range m.Pages {
+		if old[hash] {
+			continue
+		}
+		if err := c.fs.Backend.Put(pageKey(c.key, hash), nil, bytes.NewReader(pages[i+1])); err != nil {
+			return err
+		}
+	}
+	if err := c.fs.Backend.Put(c.key+metaSuffix, manifestMeta(), bytes.NewReader(pages[0])); err != nil {
+		return err
+	}
+	err = c.fs.meta.Update(c.ino, func(i *meta.Inode) {
+		i.Layout = bytes.Join(pages, nil)
+	})
+	if err != nil {
+		return err
+	}
+	for _, hash := range m.Pages {
+		delete(old, hash)
+	}
+	for hash := range old {
+		if err := c.fs.Backend.Delete(pageKey(c.key, hash)); err != nil {
+			klog.Errorf("Delete manifest page %v error %v", pageKey(c.key, hash), err)
+		}
+	}
+	return nil
+}
+
+// storedPages returns the manifest pages the layout in the inode ino
+// references.
+func (fs *FileSystem) storedPages(ino uint64) map[string]bool {
+	pages := make(map[string]bool)
+	i, err := fs.meta.GetInode(ino)
+	if err != nil || !bytes.HasPrefix(i.Layout, []byte(manifestMagic)) {
+		return pages
+	}
+	m, _, err := readManifestHeader(bufio.NewReader(bytes.NewReader(i.Layout)))
+	if err != nil {
+		return pages
+	}
+	for _, hash := range m.Pages {
+		pages[hash] = true
+	}
+	return pages
 }
 
 func (c *ChunkWriter) Release() {
+	if c.uploader != nil {
+		c.uploader.wait()
+		c.uploader = nil
+	}
 	c.index = 0
 	c.isError = false
 	c.length = 0
@@ -358,13 +565,19 @@ func (c *ChunkWriter) Release() {
 }
 
 type ChunkReader struct {
+	ino        uint64
 	key        string
 	fs         *FileSystem
 	compress   Compress
 	ErrState   bool
 	ChunkMetas []ChunkMeta `json:"chunk_metas"`
-	c          ChunkReadCache
-	ec         ChunkReadCache
+	// chunks holds the positions in ChunkMetas of the chunks that are
+	// not empty, by offset.
+	chunks   []int
+	manifest *Manifest
+	c        ChunkReadCache
+	ec       ChunkReadCache
+	ra       *readahead
 }
 
 type ChunkReadCache struct {
@@ -373,8 +586,9 @@ type ChunkReadCache struct {
 	offset int64
 }
 
-func NewChunkReader(key string, fs *FileSystem, compress string, isFixed bool) CommonReader {
+func NewChunkReader(ino uint64, key string, fs *FileSystem, compress string, isFixed bool) CommonReader {
 	r := &ChunkReader{
+		ino:      ino,
 		key:      key,
 		fs:       fs,
 		ErrState: false,
@@ -390,25 +604,22 @@ func NewChunkReader(key string, fs *FileSystem, compress string, isFixed bool) C
 		r.c.buf = make([]byte, ChunkCacheDynamicReadSize, ChunkCacheDynamicReadSize)
 		r.ec.buf = make([]byte, ChunkCacheDynamicReadSize, ChunkCacheDynamicReadSize)
 	}
+	r.ra = newReadahead(fs.readahead, r.block)
+	r.compress = newCompress(codecName(compress))
+	return r
+}
 
-	if compress != "" {
-		r.compress = Compress{
-			Enable:      true,
-			CompressBuf: make([]byte, ChunkCacheFixedSize, ChunkCacheFixedSize),
-		}
-		if !isFixed {
-			r.compress.CompressBuf = make([]byte, ChunkCacheDynamicReadSize, ChunkCacheDynamicReadSize)
-		}
-		switch compress {
-		case "zstd":
-			r.compress.Compress = &zstd.ZStandard{}
-		case "lz4":
-			r.compress.Compress = &lz4.LZ4{}
-		case "snappy":
-			r.compress.Compress = &snappy.Snappy{}
-		}
+// configure sets the reader up for the file the manifest m describes, a
+// manifest without version is read with the settings of the mount.
+func (c *ChunkReader) configure(m *Manifest) {
+	if m.Version == 0 {
+		return
+	}
+	c.compress = newCompress(m.Codec)
+	if n := m.maxChunk(); int64(len(c.c.buf)) < n {
+		c.c.buf = make([]byte, n)
+		c.ec.buf = make([]byte, n)
 	}
-	return r
 }
 
 func (c *ChunkReader) ReadAt(p []byte, offset int64) (n int, err error) {
@@ -417,7 +628,7 @@ func (c *ChunkReader) ReadAt(p []byte, offset int64) (n int, err error) {
 		return 0, fmt.Errorf("read is in error state")
 	}
 
-	if offset == 0 {
+	if offset == 0 || c.ChunkMetas == nil {
 		if err := c.doInit(); err != nil {
 			klog.Errorf("ReadAt Do Init error %v", err)
 			c.ErrState = true
@@ -438,113 +649,210 @@ func (c *ChunkReader) ReadAt(p []byte, offset int64) (n int, err error) {
 	}
 
 	// Cache Miss
-	first, second := c.determinePack(offset, int64(len(p)))
-	if first == -1 {
-		klog.Errorf("can not find appropriate pack id")
-		c.ErrState = true
-		return 0, fmt.Errorf("read is in error state")
-	}
-	// Once
-	if err = c.doDownload(first, c.c.buf); err != nil {
-		c.ErrState = true
-		return 0, err
-	}
-	c.c.start, c.c.offset = c.doBound(first)
-	if second == -1 {
-		st := offset - c.c.start
-		copy(p, c.c.buf[st:st+int64(len(p))])
-		return len(p), nil
+	end := offset + int64(len(p))
+	pos := offset
+	for k := c.chunkAt(offset); k < len(c.chunks) && pos < end; k++ {
+		m := c.ChunkMetas[c.chunks[k]]
+		if m.Start > pos {
+			// A gap in the layout reads as zeros.
+			to := m.Start
+			if to > end {
+				to = end
+			}
+			gap := p[pos-offset : to-offset]
+			for i := range gap {
+				gap[i] = 0
+			}
+			if pos = to; pos == end {
+				break
+			}
+		}
+		buf, err := c.chunk(c.chunks[k])
+		if err != nil {
+			c.ErrState = true
+			return 0, err
+		}
+		to := m.End
+		if to > end {
+			to = end
+		}
+		copy(p[pos-offset:to-offset], buf[pos-m.Start:to-m.Start])
+		pos = to
 	}
-	// Twice
-	if err = c.doDownload(second, c.ec.buf); err != nil {
-		c.ErrState = true
-		return 0, err
+	if pos < end {
+		return int(pos - offset), io.EOF
 	}
-	c.ec.start, c.ec.offset = c.doBound(second)
-	copy(p[:c.c.offset-offset], c.c.buf[offset-c.c.start:])
-	copy(p[c.c.offset-offset:], c.ec.buf)
 	return len(p), nil
 }
 
-func (c *ChunkReader) determinePack(off int64, l int64) (first, second int) {
-	first, second = -1, -1
-	length := len(c.ChunkMetas)
-	for _, v := range c.ChunkMetas {
-		if v.Start >= v.End {
-			continue
-		}
-		if off >= v.End || off < v.Start {
-			continue
-		}
-		if off >= v.Start {
-			if off+l <= v.End {
-				first = v.Index
-				break
-			}
-			first, second = v.Index, v.Index+1
+// setChunks sets the chunk layout read and indexes its chunks by offset.
+func (c *ChunkReader) setChunks(metas []ChunkMeta) {
+	c.ChunkMetas = metas
+	c.chunks = c.chunks[:0]
+	for i, m := range metas {
+		if m.Start < m.End {
+			c.chunks = append(c.chunks, i)
 		}
 	}
+	sort.Slice(c.chunks, func(i, j int) bool {
+		return metas[c.chunks[i]].Start < metas[c.chunks[j]].Start
+	})
+}
 
-	if first >= 0 && first < length {
-		if c.ChunkMetas[first].Start >= c.ChunkMetas[first].End {
-			first = -1
-		}
-	}
-	if second >= 0 && second < length {
-		if c.ChunkMetas[second].Start >= c.ChunkMetas[second].End {
-			second = -1
-		}
-	}
-	return
+// chunkAt returns the position in the offset index of the first chunk that
+// ends after off, len(c.chunks) when there is none.
+func (c *ChunkReader) chunkAt(off int64) int {
+	return sort.Search(len(c.chunks), func(k int) bool {
+		return c.ChunkMetas[c.chunks[k]].End > off
+	})
 }
 
-func (c *ChunkReader) doBound(inx int) (start, end int64) {
-	for _, v := range c.ChunkMetas {
-		if v.Index == inx {
-			start = v.Start
-			end = v.End
-			return
-		}
+// chunk returns the data of the chunk index. The two read caches hold the
+// chunks read last, one of them is reused or else the older one is loaded.
+func (c *ChunkReader) chunk(index int) ([]byte, error) {
+	m := c.ChunkMetas[index]
+	if c.c.start == m.Start && c.c.offset == m.End {
+		return c.c.buf, nil
+	}
+	c.c, c.ec = c.ec, c.c
+	if c.c.start == m.Start && c.c.offset == m.End {
+		return c.c.buf, nil
 	}
-	return
+	c.c.start, c.c.offset = 0, 0
+	if err := c.load(index, c.c.buf); err != nil {
+		return nil, err
+	}
+	c.c.start, c.c.offset = m.Start, m.End
+	return c.c.buf, nil
 }
 
 func (c *ChunkReader) doInit() error {
-	buf := make([]byte, 1<<20)
-	n, err := c.fs.Backend.Get(c.key+"/.meta", 0, -1, buf)
+	m, err := c.fs.loadManifest(c.ino, c.key)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(buf[:n], &c.ChunkMetas); err != nil {
-		return err
-	}
+	c.configure(m)
+	c.manifest = m
+	c.setChunks(m.Chunks)
 	return nil
 }
 
+// loadManifest returns the manifest of a chunked file, from the inode or
+// else from <key>/.meta.
+func (fs *FileSystem) loadManifest(ino uint64, key string) (*Manifest, error) {
+	if i, err := fs.meta.GetInode(ino); err == nil && len(i.Layout) > 0 {
+		return decodeManifest(i.Layout)
+	}
+	return getManifest(fs.Backend, key)
+}
+
+// load reads the chunk index into buf, from the readahead when it was
+// prefetched.
+func (c *ChunkReader) load(index int, buf []byte) error {
+	if _, ok := c.ra.take(index, buf); ok {
+		return nil
+	}
+	m := c.ChunkMetas[index]
+	return c.cached(m, buf, func(buf []byte) error {
+		return c.doDownload(index, buf)
+	})
+}
+
+// cached reads the chunk m through the block cache, chunks stored before
+// their hash was recorded are always downloaded.
+func (c *ChunkReader) cached(m ChunkMeta, buf []byte, download func(buf []byte) error) error {
+	if m.Hash == "" || m.Hole {
+		return download(buf)
+	}
+	return c.fs.blocks.read(blockKey{hash: m.Hash}, 0, buf[:m.End-m.Start], download)
+}
+
+// block describes the chunk index to the readahead, the fetch keeps a copy
+// of the chunk meta, the key and the codec since the layout may be reloaded
+// meanwhile.
+func (c *ChunkReader) block(index int) (int64, func(buf []byte) error) {
+	if index < 0 || index >= len(c.ChunkMetas) {
+		return 0, nil
+	}
+	m := c.ChunkMetas[index]
+	if m.Start >= m.End {
+		return 0, nil
+	}
+	key, z := c.key, c.compress
+	z.CompressBuf = nil
+	return m.End - m.Start, func(buf []byte) error {
+		return c.cached(m, buf, func(buf []byte) error {
+			return c.download(key, z, m, buf, nil)
+		})
+	}
+}
+
 func (c *ChunkReader) doDownload(index int, buf []byte) error {
-	if !c.compress.Enable {
-		if _, err := c.fs.Backend.Get(c.key+"/"+strconv.Itoa(index), 0, -1, buf); err != nil {
-			return err
+	m := c.ChunkMetas[index]
+	if m.CompressSize > int64(len(c.compress.CompressBuf)) {
+		c.compress.CompressBuf = make([]byte, m.CompressSize, m.CompressSize)
+	}
+	return c.download(c.key, c.compress, m, buf, c.compress.CompressBuf)
+}
+
+// download reads the chunk m of the file key into buf, a chunk compressed
+// with z is first read into zbuf, which is allocated when it is too small.
+func (c *ChunkReader) download(key string, z Compress, m ChunkMeta, buf, zbuf []byte) error {
+	if m.Hole {
+		hole := buf[:m.End-m.Start]
+		for i := range hole {
+			hole[i] = 0
 		}
 		return nil
 	}
+	if !z.Enable {
+		return c.fetch(key, m, buf[:m.End-m.Start])
+	}
 	// Decompress
-	if c.ChunkMetas[index].CompressSize > int64(len(c.compress.CompressBuf)) {
-		c.compress.CompressBuf = make([]byte, c.ChunkMetas[index].CompressSize, c.ChunkMetas[index].CompressSize)
+	if m.CompressSize > int64(len(zbuf)) {
+		zbuf = make([]byte, m.CompressSize)
 	}
-	if _, err := c.fs.Backend.Get(c.key+"/"+strconv.Itoa(index), 0, -1, c.compress.CompressBuf[:c.ChunkMetas[index].CompressSize]); err != nil {
+	if err := c.fetch(key, m, zbuf[:m.CompressSize]); err != nil {
 		return err
 	}
-	if _, err := c.compress.Compress.Decompress(buf, c.compress.CompressBuf[:c.ChunkMetas[index].CompressSize]); err != nil {
+	if _, err := z.Compress.Decompress(buf, zbuf[:m.CompressSize]); err != nil {
 		return err
 	}
 	return nil
 }
 
+// fetch reads the stored chunk m of the file key into buf, from the disk
+// cache when it is there.
+func (c *ChunkReader) fetch(key string, m ChunkMeta, buf []byte) error {
+	var path string
+	if m.Hash != "" && c.fs.disk != nil {
+		path = c.fs.disk.chunkPath(m.Hash)
+		if c.fs.disk.get(path, m.Hash, buf) {
+			return nil
+		}
+	}
+	n, err := c.fs.Backend.Get(chunkObject(key, m), 0, -1, buf)
+	if err != nil {
+		return err
+	}
+	if n < len(buf) {
+		klog.Errorf("Download chunk %v/%d short read %d < %d", key, m.Index, n, len(buf))
+		return io.ErrUnexpectedEOF
+	}
+	if path != "" {
+		c.fs.disk.put(path, m.Hash, buf)
+	}
+	return nil
+}
+
 func (c *ChunkReader) Release() {
 	c.c.start = 0
 	c.c.offset = 0
 	c.ec.start = 0
 	c.ec.offset = 0
 	c.ErrState = false
+	c.ChunkMetas = nil
+	c.chunks = nil
+	c.manifest = nil
+	c.ra.reset()
 }
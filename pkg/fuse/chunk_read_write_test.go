@@ -0,0 +1,197 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+	"github.com/nevermore/muyifs/pkg/meta"
+)
+
+// chunkPuts counts the chunks uploaded to the store.
+type chunkPuts struct {
+	backend.ObjectStorage
+	sync.Mutex
+	n int
+}
+
+func (s *chunkPuts) Put(key string, metadata map[string]string, in io.Reader) error {
+	if strings.HasPrefix(key, chunkPrefix) {
+		s.Lock()
+		s.n++
+		s.Unlock()
+	}
+	return s.ObjectStorage.Put(key, metadata, in)
+}
+
+func TestSharedChunks(t *testing.T) {
+	for _, c := range chunkings {
+		t.Run(fmt.Sprint(c), func(t *testing.T) {
+			inner := mem.NewMemClient("t")
+			store := &chunkPuts{ObjectStorage: inner}
+			fs := mountTest(t, store, t.TempDir(), true, c.fixed, c.compress)
+			data := testData(3*ChunkCacheFixedSize, 26)
+			a := writeFile(t, rootDir(fs), "a", data)
+			uploaded := store.n
+			chunks, _ := inner.List(chunkPrefix)
+			if uploaded == 0 || len(chunks) != uploaded {
+				t.Fatalf("%d chunks uploaded and %d stored", uploaded, len(chunks))
+			}
+
+			// a copy of the data uploads no chunk
+			b := writeFile(t, rootDir(fs), "b", data)
+			if store.n != uploaded {
+				t.Fatalf("copy of a file uploaded %d chunks", store.n-uploaded)
+			}
+			la, lb := layoutTest(t, a), layoutTest(t, b)
+			for i := range la {
+				if la[i].Hash == "" || la[i].Hash != lb[i].Hash {
+					t.Fatalf("chunk %d stored as %q and %q", i, la[i].Hash, lb[i].Hash)
+				}
+			}
+			if !bytes.Equal(readFile(t, b), data) {
+				t.Fatalf("file of shared chunks read back wrong data")
+			}
+		})
+	}
+}
+
+func TestReservedName(t *testing.T) {
+	fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), true, true, "")
+	root := rootDir(fs)
+	name := strings.TrimSuffix(reservedPrefix, "/")
+	if _, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: name, Mode: 0755}); err != fuse.Errno(syscall.EPERM) {
+		t.Fatalf("mkdir of the reserved name = %v", err)
+	}
+	req := &fuse.CreateRequest{Name: name, Mode: 0644, Flags: fuse.OpenReadWrite}
+	if _, _, err := root.Create(ctx, req, &fuse.CreateResponse{}); err != fuse.Errno(syscall.EPERM) {
+		t.Fatalf("create of the reserved name = %v", err)
+	}
+	writeFile(t, root, "f", []byte("data"))
+	if err := root.Rename(ctx, &fuse.RenameRequest{OldName: "f", NewName: name}, root); err != fuse.Errno(syscall.EPERM) {
+		t.Fatalf("rename to the reserved name = %v", err)
+	}
+	// the name is only reserved in the root
+	writeFile(t, mkdirTest(t, root, "d"), name, []byte("data"))
+}
+
+func TestReservedCollision(t *testing.T) {
+	for _, key := range []string{".muyifs", ".muyifs/f", ".muyifs/chunks/f", ".muyifs/chunks/x/"} {
+		store := mem.NewMemClient("t")
+		fs := mountTest(t, store, t.TempDir(), true, true, "")
+		writeFile(t, rootDir(fs), "f", testData(ChunkCacheFixedSize+1000, 27))
+		if key[len(key)-1] == '/' {
+			store.PutDirectory(key)
+		} else {
+			store.Put(key, nil, bytes.NewReader([]byte("user data")))
+		}
+		fs.meta.Close()
+
+		fs = NewFileSystem("/mnt", t.TempDir(), "", true, true, &Option{})
+		fs.Backend = store
+		if _, err := fs.reloadData("/mnt"); err == nil {
+			t.Fatalf("mount with the object %s succeeded", key)
+		}
+		fs.meta.Close()
+	}
+
+	// an entry stored before the name was reserved
+	datapath := t.TempDir()
+	fs := mountTest(t, mem.NewMemClient("t"), datapath, true, true, "")
+	ino, _ := fs.meta.NextInode()
+	err := fs.meta.Create(meta.RootInode, ".muyifs", &meta.Inode{Ino: ino, Type: uint32(fuse.DT_File), Nlink: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.reloadData("/mnt"); err == nil {
+		t.Fatalf("mount with a file of the reserved name succeeded")
+	}
+}
+
+func TestChunkAt(t *testing.T) {
+	r := &ChunkReader{}
+	// out of order, with an empty chunk and a gap
+	r.setChunks([]ChunkMeta{
+		{Index: 0, Start: 20, End: 30},
+		{Index: 1, Start: 0, End: 10},
+		{Index: 2, Start: 10, End: 10},
+		{Index: 3, Start: 12, End: 20},
+	})
+	for _, c := range []struct {
+		off  int64
+		want int
+	}{{0, 1}, {9, 1}, {10, 3}, {11, 3}, {12, 3}, {19, 3}, {20, 0}, {29, 0}, {30, -1}} {
+		k := r.chunkAt(c.off)
+		got := -1
+		if k < len(r.chunks) {
+			got = r.ChunkMetas[r.chunks[k]].Index
+		}
+		if got != c.want {
+			t.Errorf("chunk at %d = %d, want %d", c.off, got, c.want)
+		}
+	}
+}
+
+func TestReadAcrossChunks(t *testing.T) {
+	fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), true, true, "lz4")
+	f := writeFile(t, rootDir(fs), "f", nil)
+	w := NewChunkWriter(f.id, "f", fs, "lz4", true).(*ChunkWriter)
+	defer w.Release()
+	var metas []ChunkMeta
+	for _, c := range []struct {
+		index      int
+		start, end int64
+		data       string
+	}{{2, 20, 22, "cc"}, {0, 0, 4, "aaaa"}, {1, 10, 14, "bbbb"}} {
+		n, id, err := w.putChunk([]byte(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		metas = append(metas, ChunkMeta{Index: c.index, Start: c.start, End: c.end, CompressSize: n, Hash: id.String()})
+	}
+	metas = append(metas, ChunkMeta{Index: 3, Start: 14, End: 20, Hole: true}, ChunkMeta{Index: 4, Start: 22})
+	if err := w.putLayout(metas); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewChunkReader(f.id, "f", fs, "", true).(*ChunkReader)
+	defer r.Release()
+	want := "aaaa\x00\x00\x00\x00\x00\x00bbbb\x00\x00\x00\x00\x00\x00cc"
+	for off := 0; off < len(want); off++ {
+		p := make([]byte, len(want)-off)
+		if n, err := r.ReadAt(p, int64(off)); err != nil || string(p[:n]) != want[off:] {
+			t.Fatalf("read at %d = %q, %v", off, p[:n], err)
+		}
+	}
+	p := make([]byte, 10)
+	if n, err := r.ReadAt(p, 18); err != io.EOF || string(p[:n]) != want[18:] {
+		t.Fatalf("read past the end = %q, %v", p[:n], err)
+	}
+}
+
+func TestReadManyChunks(t *testing.T) {
+	for _, c := range chunkings {
+		t.Run(fmt.Sprint(c), func(t *testing.T) {
+			fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), true, c.fixed, c.compress)
+			data := testData(5*ChunkCacheFixedSize+1000, 31)
+			f := writeFile(t, rootDir(fs), "f", data)
+			if n := len(layoutTest(t, f)); n < 3 {
+				t.Fatalf("file stored in %d chunks", n)
+			}
+			r := NewChunkReader(f.id, "f", fs, c.compress, c.fixed).(*ChunkReader)
+			defer r.Release()
+			// one read spans all of the chunks
+			p := make([]byte, len(data)-100)
+			if n, err := r.ReadAt(p, 100); err != nil || !bytes.Equal(p[:n], data[100:]) {
+				t.Fatalf("read across all chunks read back %d bytes, %v", n, err)
+			}
+		})
+	}
+}
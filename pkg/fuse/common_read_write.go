@@ -18,6 +18,10 @@ type ChunkMeta struct {
 	Start        int64 `json:"start"`
 	End          int64 `json:"end"`
 	CompressSize int64 `json:"compress_size,omitempty"`
+	// Hole marks a zero-filled range that has no object.
+	Hole bool `json:"hole,omitempty"`
+	// Hash is the hex sha256 of the stored chunk.
+	Hash string `json:"hash,omitempty"`
 }
 
 type CommonWriter interface {
@@ -3,12 +3,15 @@ package fuse
 import (
 	"bytes"
 	"context"
+	"net/url"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/nevermore/muyifs/pkg/meta"
 	"k8s.io/klog/v2"
 )
 
@@ -73,7 +76,13 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	resp.Attr.Gid = d.attr.Gid
 	resp.Attr.Atime = d.attr.Atime
 	resp.Attr.Mtime = d.attr.Mtime
-	return nil
+	return d.save()
+}
+
+func (d *Dir) save() error {
+	return d.fs.meta.Update(d.id, func(i *meta.Inode) {
+		setInode(i, d.attr)
+	})
 }
 
 func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
@@ -129,8 +138,20 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	return dirent, nil
 }
 
+// reserved tells whether name is kept for the objects of the file system.
+func (d *Dir) reserved(name string) bool {
+	return d.id == meta.RootInode && name+"/" == reservedPrefix
+}
+
 func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
-	newInode := GenerateInode()
+	if d.reserved(req.Name) {
+		return nil, fuse.Errno(syscall.EPERM)
+	}
+	newInode, err := d.fs.GenerateInode()
+	if err != nil {
+		klog.Errorf("Mkdir %v generate inode error %v", req.Name, err)
+		return nil, err
+	}
 	ts := time.Now()
 	dir := &Dir{
 		id:     newInode,
@@ -154,7 +175,11 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 		},
 	}
 	if err := d.fs.Backend.PutDirectory(d.String() + req.Name + "/"); err != nil {
-		klog.Error("Mkdir and put directory %v error %v", req.Name, err)
+		klog.Errorf("Mkdir and put directory %v error %v", req.Name, err)
+		return nil, err
+	}
+	if err := d.fs.meta.Create(d.id, req.Name, toInode(newInode, dir.typ, dir.attr)); err != nil {
+		klog.Errorf("Mkdir and save directory %v error %v", req.Name, err)
 		return nil, err
 	}
 	d.DirChild = append(d.DirChild, dir)
@@ -162,14 +187,19 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 }
 
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	newInode := GenerateInode()
+	if d.reserved(req.Name) {
+		return nil, nil, fuse.Errno(syscall.EPERM)
+	}
+	newInode, err := d.fs.GenerateInode()
+	if err != nil {
+		klog.Errorf("Create %v generate inode error %v", req.Name, err)
+		return nil, nil, err
+	}
 	ts := time.Now()
-	f := &File{
-		id:     newInode,
-		parent: d,
-		name:   req.Name,
-		typ:    fuse.DT_File,
-		fs:     d.fs,
+	f := newFile(d, req.Name, &Inode{
+		id:  newInode,
+		typ: fuse.DT_File,
+		fs:  d.fs,
 		attr: &fuse.Attr{
 			Valid: time.Second,
 			Inode: newInode,
@@ -178,40 +208,97 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 			Mtime: ts,
 			Ctime: ts,
 			Mode:  req.Mode,
+			Nlink: 1,
 			Uid:   req.Uid,
 			Gid:   req.Gid,
 		},
-	}
-
-	h := NewFileHandle(f, req.Uid, req.Gid)
-	h.ID = newInode
+	})
 
-	if d.fs.chunk {
-		h.reader = NewChunkReader(d.String()+req.Name, d.fs, d.fs.compress, d.fs.isFixed)
-		h.writer = NewChunkWriter(d.String()+req.Name, d.fs, d.fs.compress, d.fs.isFixed)
-	} else {
-		h.reader = NewReader(d.String()+req.Name, d.fs)
-		h.writer = NewWriter(d.String()+req.Name, d.fs)
-	}
 	if err := d.fs.Backend.Put(d.String()+req.Name, map[string]string{}, bytes.NewReader([]byte{})); err != nil {
-		klog.Error("Create and put file %v error %v", req.Name, err)
+		klog.Errorf("Create and put file %v error %v", req.Name, err)
+		return nil, nil, err
+	}
+	if err := d.fs.meta.Create(d.id, req.Name, toInode(newInode, f.typ, f.attr)); err != nil {
+		klog.Errorf("Create and save file %v error %v", req.Name, err)
 		return nil, nil, err
 	}
 
 	d.FileChild = append(d.FileChild, f)
-	d.fs.Lock()
-	d.fs.handler[newInode] = h
-	d.fs.Unlock()
+	h := d.fs.openHandle(f, req.Uid, req.Gid, req.Flags)
 	return f, h, nil
 }
 
+func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if d.reserved(req.NewName) {
+		return nil, fuse.Errno(syscall.EPERM)
+	}
+	newInode, err := d.fs.GenerateInode()
+	if err != nil {
+		klog.Errorf("Symlink %v generate inode error %v", req.NewName, err)
+		return nil, err
+	}
+	ts := time.Now()
+	f := newFile(d, req.NewName, &Inode{
+		id:     newInode,
+		typ:    fuse.DT_Link,
+		fs:     d.fs,
+		target: req.Target,
+		attr: &fuse.Attr{
+			Valid: time.Second,
+			Inode: newInode,
+			Size:  uint64(len(req.Target)),
+			Atime: ts,
+			Mtime: ts,
+			Ctime: ts,
+			Mode:  os.ModeSymlink | 0777,
+			Nlink: 1,
+			Uid:   req.Uid,
+			Gid:   req.Gid,
+		},
+	})
+	metadata := map[string]string{SymlinkKey: url.PathEscape(req.Target)}
+	if err := d.fs.Backend.Put(d.String()+req.NewName, metadata, bytes.NewReader([]byte{})); err != nil {
+		klog.Errorf("Symlink and put %v error %v", req.NewName, err)
+		return nil, err
+	}
+	i := toInode(newInode, f.typ, f.attr)
+	i.Target = req.Target
+	if err := d.fs.meta.Create(d.id, req.NewName, i); err != nil {
+		klog.Errorf("Symlink and save %v error %v", req.NewName, err)
+		return nil, err
+	}
+	d.FileChild = append(d.FileChild, f)
+	return f, nil
+}
+
 func (d *Dir) Forget() {
 	klog.Infof("Forget dir %s", d.name)
 }
 
 func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
-	klog.Infof("Dir Link")
-	return nil, nil
+	of, ok := old.(*File)
+	if !ok || d.reserved(req.NewName) {
+		return nil, fuse.Errno(syscall.EPERM)
+	}
+	// Pin the data to the key it has now, it no longer follows a single path.
+	key := of.dataKey()
+	nlink := uint32(len(of.links) + 1)
+	ts := time.Now()
+	err := d.fs.meta.Link(d.id, req.NewName, of.id, func(i *meta.Inode) {
+		i.Key = key
+		i.Nlink = nlink
+		i.Ctime = ts
+	})
+	if err != nil {
+		klog.Errorf("Link and save %v error %v", req.NewName, err)
+		return nil, err
+	}
+	of.key = key
+	of.attr.Nlink = nlink
+	of.attr.Ctime = ts
+	f := newFile(d, req.NewName, of.Inode)
+	d.FileChild = append(d.FileChild, f)
+	return f, nil
 }
 
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
@@ -227,6 +314,9 @@ func (d *Dir) removeDir(req *fuse.RemoveRequest) error {
 			if err := d.fs.Backend.Delete(d.String() + req.Name + "/"); err != nil {
 				return err
 			}
+			if err := d.fs.meta.Remove(d.id, f.name, f.id); err != nil {
+				return err
+			}
 			d.DirChild = append(d.DirChild[:i], d.DirChild[i+1:]...)
 			return nil
 		}
@@ -237,15 +327,259 @@ func (d *Dir) removeDir(req *fuse.RemoveRequest) error {
 func (d *Dir) removeFile(req *fuse.RemoveRequest) error {
 	for i, f := range d.FileChild {
 		if f.name == req.Name {
-			if err := d.fs.Backend.DeleteList(d.String() + req.Name + "/"); err != nil {
+			if len(f.links) > 1 {
+				if err := d.unlink(f); err != nil {
+					return err
+				}
+				d.FileChild = append(d.FileChild[:i], d.FileChild[i+1:]...)
+				return nil
+			}
+			if err := d.fs.deleteObjects(f.dataKey()); err != nil {
 				return err
 			}
-			if err := d.fs.Backend.Delete(d.String() + req.Name); err != nil {
+			if err := d.fs.meta.Remove(d.id, f.name, f.id); err != nil {
 				return err
 			}
+			f.links = nil
 			d.FileChild = append(d.FileChild[:i], d.FileChild[i+1:]...)
 			return nil
 		}
 	}
 	return nil
 }
+
+// unlink drops f while other links keep the file alive. The data moves to
+// another link when it is stored under the path of f.
+func (d *Dir) unlink(f *File) error {
+	unlock, err := d.fs.lockOpen([]*File{f})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	links := removeFileChild(append([]*File(nil), f.links...), f)
+	key := f.key
+	if key == f.path() {
+		key = links[0].path()
+		if err := d.fs.moveObjects(f.key, key); err != nil {
+			klog.Errorf("Unlink move %v to %v error %v", f.key, key, err)
+			return err
+		}
+	}
+	nlink := uint32(len(links))
+	ts := time.Now()
+	err = d.fs.meta.Unlink(d.id, f.name, f.id, func(i *meta.Inode) {
+		i.Key = key
+		i.Nlink = nlink
+		i.Ctime = ts
+	})
+	if err != nil {
+		return err
+	}
+	f.key = key
+	f.links = links
+	f.attr.Nlink = nlink
+	f.attr.Ctime = ts
+	f.reopen()
+	return nil
+}
+
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	nd, ok := newDir.(*Dir)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	if d == nd && req.OldName == req.NewName {
+		return nil
+	}
+	if nd.reserved(req.NewName) {
+		return fuse.Errno(syscall.EPERM)
+	}
+
+	srcDir, srcFile := d.child(req.OldName)
+	if srcDir == nil && srcFile == nil {
+		return fuse.Errno(syscall.ENOENT)
+	}
+	for t := nd; srcDir != nil && t != nil; t = t.parent {
+		if t == srcDir {
+			// can not move a directory into itself
+			return fuse.Errno(syscall.EINVAL)
+		}
+	}
+
+	dstDir, dstFile := nd.child(req.NewName)
+	if srcFile != nil && dstFile != nil && srcFile.Inode == dstFile.Inode {
+		// both names are links to the same file
+		return nil
+	}
+	switch {
+	case srcDir != nil && dstFile != nil:
+		return fuse.Errno(syscall.ENOTDIR)
+	case srcFile != nil && dstDir != nil:
+		return fuse.Errno(syscall.EISDIR)
+	case dstDir != nil && (len(dstDir.DirChild) > 0 || len(dstDir.FileChild) > 0):
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
+
+	// Open files that move or go away are flushed first and stay locked
+	// until they follow their new keys.
+	var files []*File
+	if srcDir != nil {
+		files = srcDir.files(files)
+	} else {
+		files = append(files, srcFile)
+	}
+	if dstFile != nil {
+		files = append(files, dstFile)
+	}
+	unlock, err := d.fs.lockOpen(files)
+	if err != nil {
+		klog.Errorf("Rename flush %v error %v", req.OldName, err)
+		return err
+	}
+	defer unlock()
+
+	oldKey, newKey := d.String()+req.OldName, nd.String()+req.NewName
+	if srcDir != nil {
+		oldKey, newKey = oldKey+"/", newKey+"/"
+	}
+	// A replaced file that has other links keeps its data, it moves to
+	// another link when it is stored under the replaced name.
+	var dstLinks []*File
+	if dstFile != nil && len(dstFile.links) > 1 {
+		dstLinks = removeFileChild(append([]*File(nil), dstFile.links...), dstFile)
+		if dstFile.dataKey() == newKey {
+			key := dstLinks[0].path()
+			if err := d.fs.moveObjects(newKey, key); err != nil {
+				klog.Errorf("Rename move %v to %v error %v", newKey, key, err)
+				return err
+			}
+			if err := d.fs.meta.Update(dstFile.id, func(i *meta.Inode) { i.Key = key }); err != nil {
+				return err
+			}
+			dstFile.key = key
+			dstFile.reopen()
+		}
+	}
+
+	// The data of a linked file may be stored under another of its links.
+	moved := srcDir != nil || srcFile.dataKey() == oldKey
+	if moved {
+		if err := d.fs.moveObjects(oldKey, newKey); err != nil {
+			klog.Errorf("Rename move %v to %v error %v", oldKey, newKey, err)
+			return err
+		}
+	}
+	ts := time.Now()
+	var unlink func(i *meta.Inode)
+	if dstLinks != nil {
+		nlink := uint32(len(dstLinks))
+		unlink = func(i *meta.Inode) {
+			i.Nlink = nlink
+			i.Ctime = ts
+		}
+	}
+	if err := d.fs.meta.Rename(d.id, req.OldName, nd.id, req.NewName, unlink); err != nil {
+		klog.Errorf("Rename save %v error %v", req.NewName, err)
+		return err
+	}
+
+	switch {
+	case dstDir != nil:
+		nd.DirChild = removeDirChild(nd.DirChild, dstDir)
+	case dstLinks != nil:
+		nd.FileChild = removeFileChild(nd.FileChild, dstFile)
+		dstFile.links = dstLinks
+		dstFile.attr.Nlink = uint32(len(dstLinks))
+		dstFile.attr.Ctime = ts
+	case dstFile != nil:
+		nd.FileChild = removeFileChild(nd.FileChild, dstFile)
+		dstFile.links = nil
+		if !moved {
+			// nothing took the place of its objects
+			if err := d.fs.deleteObjects(newKey); err != nil {
+				klog.Errorf("Rename delete %v error %v", newKey, err)
+			}
+		}
+	}
+
+	if srcDir != nil {
+		d.DirChild = removeDirChild(d.DirChild, srcDir)
+		srcDir.parent, srcDir.name = nd, req.NewName
+		srcDir.attr.Ctime = ts
+		nd.DirChild = append(nd.DirChild, srcDir)
+		if err := srcDir.rekey(oldKey, newKey); err != nil {
+			return err
+		}
+		return srcDir.save()
+	}
+	d.FileChild = removeFileChild(d.FileChild, srcFile)
+	srcFile.parent, srcFile.name = nd, req.NewName
+	srcFile.attr.Ctime = ts
+	if srcFile.key == oldKey {
+		srcFile.key = newKey
+	}
+	nd.FileChild = append(nd.FileChild, srcFile)
+	srcFile.reopen()
+	return srcFile.save()
+}
+
+// files appends all files below d to s.
+func (d *Dir) files(s []*File) []*File {
+	for _, dd := range d.DirChild {
+		s = dd.files(s)
+	}
+	return append(s, d.FileChild...)
+}
+
+func (d *Dir) child(name string) (*Dir, *File) {
+	for _, dd := range d.DirChild {
+		if dd.name == name {
+			return dd, nil
+		}
+	}
+	for _, ff := range d.FileChild {
+		if ff.name == name {
+			return nil, ff
+		}
+	}
+	return nil, nil
+}
+
+// rekey updates all files below d after their objects moved from the
+// prefix oldKey to newKey, and points their open handles at the new keys.
+// The open files below d are locked by the caller.
+func (d *Dir) rekey(oldKey, newKey string) error {
+	for _, dd := range d.DirChild {
+		if err := dd.rekey(oldKey, newKey); err != nil {
+			return err
+		}
+	}
+	for _, ff := range d.FileChild {
+		if strings.HasPrefix(ff.key, oldKey) {
+			ff.key = newKey + strings.TrimPrefix(ff.key, oldKey)
+			if err := ff.save(); err != nil {
+				return err
+			}
+		}
+		ff.reopen()
+	}
+	return nil
+}
+
+func removeDirChild(s []*Dir, d *Dir) []*Dir {
+	for i := range s {
+		if s[i] == d {
+			return append(s[:i], s[i+1:]...)
+		}
+	}
+	return s
+}
+
+func removeFileChild(s []*File, f *File) []*File {
+	for i := range s {
+		if s[i] == f {
+			return append(s[:i], s[i+1:]...)
+		}
+	}
+	return s
+}
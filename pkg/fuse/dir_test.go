@@ -0,0 +1,236 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+func renameTest(t *testing.T, d *Dir, oldName string, nd *Dir, newName string) {
+	t.Helper()
+	if err := d.Rename(ctx, &fuse.RenameRequest{OldName: oldName, NewName: newName}, nd); err != nil {
+		t.Fatalf("rename %s to %s: %v", oldName, newName, err)
+	}
+}
+
+func mkdirTest(t *testing.T, d *Dir, name string) *Dir {
+	t.Helper()
+	n, err := d.Mkdir(ctx, &fuse.MkdirRequest{Name: name, Mode: 0755})
+	if err != nil {
+		t.Fatalf("mkdir %s: %v", name, err)
+	}
+	return n.(*Dir)
+}
+
+func TestRenameOpenFile(t *testing.T) {
+	for _, c := range append([]chunking{{}}, chunkings...) {
+		chunk := c != chunking{}
+		t.Run(fmt.Sprintf("chunk=%v,%v", chunk, c), func(t *testing.T) {
+			fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), chunk, c.fixed, c.compress)
+			root := rootDir(fs)
+			d := mkdirTest(t, root, "d")
+			data := testData(ChunkCacheFixedSize+1000, 1)
+			f, h := createTest(t, d, "f")
+			writeTest(t, h, data, 0)
+			// a random write goes to the staging file
+			writeTest(t, h, data[:100], 10)
+			copy(data[10:], data[:100])
+
+			renameTest(t, d, "f", d, "g")
+			renameTest(t, root, "d", root, "e")
+			if got := readTest(t, h, 0, len(data)); !bytes.Equal(got, data) {
+				t.Fatalf("open handle read back wrong data after rename")
+			}
+			writeTest(t, h, []byte("tail"), int64(len(data)))
+			data = append(data, "tail"...)
+			flushTest(t, h)
+			releaseTest(t, h)
+
+			e := lookupTest(t, root, "e").(*Dir)
+			if lookupTest(t, e, "g").(*File) != f {
+				t.Fatalf("lookup of the new name found another file")
+			}
+			if !bytes.Equal(readFile(t, f), data) {
+				t.Fatalf("renamed file read back wrong data")
+			}
+			objs, _ := fs.Backend.List("d/")
+			if len(objs) != 0 {
+				t.Fatalf("objects left under the old name: %+v", objs)
+			}
+		})
+	}
+}
+
+func TestRenameReplace(t *testing.T) {
+	for _, chunk := range []bool{false, true} {
+		store := mem.NewMemClient("t")
+		fs := mountTest(t, store, t.TempDir(), chunk, true, "")
+		root := rootDir(fs)
+		a := testData(ChunkCacheFixedSize+1000, 2)
+		b := testData(3*ChunkCacheFixedSize, 3)
+		fa := writeFile(t, root, "a", a)
+		writeFile(t, root, "b", b)
+
+		// a failing move keeps both files
+		store.SetFaults(mem.Faults{FailCopy: 1})
+		err := root.Rename(ctx, &fuse.RenameRequest{OldName: "a", NewName: "b"}, root)
+		if err == nil {
+			t.Fatalf("chunk=%v: rename succeeded with a failing copy", chunk)
+		}
+		store.SetFaults(mem.Faults{})
+		if got, want := names(root), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("chunk=%v: names after a failed rename = %v", chunk, got)
+		}
+		if !bytes.Equal(readFile(t, lookupTest(t, root, "b").(*File)), b) {
+			t.Fatalf("chunk=%v: target read back wrong data after a failed rename", chunk)
+		}
+		if !bytes.Equal(readFile(t, fa), a) {
+			t.Fatalf("chunk=%v: source read back wrong data after a failed rename", chunk)
+		}
+
+		renameTest(t, root, "a", root, "b")
+		if got, want := names(root), []string{"b"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("chunk=%v: names after rename = %v", chunk, got)
+		}
+		if !bytes.Equal(readFile(t, lookupTest(t, root, "b").(*File)), a) {
+			t.Fatalf("chunk=%v: replaced file read back wrong data", chunk)
+		}
+		objs, _ := store.List("")
+		for _, o := range objs {
+			if o.Key == "a" || strings.HasPrefix(o.Key, "a/") {
+				t.Fatalf("chunk=%v: object %s left under the old name", chunk, o.Key)
+			}
+			if !chunk && strings.HasPrefix(o.Key, "b/") {
+				t.Fatalf("chunk=%v: object %s of the replaced file left", chunk, o.Key)
+			}
+		}
+	}
+}
+
+func TestRenameReplaceLinked(t *testing.T) {
+	fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), false, true, "")
+	root := rootDir(fs)
+	a := testData(1000, 4)
+	b := testData(2000, 5)
+	writeFile(t, root, "a", a)
+	fb := writeFile(t, root, "b", b)
+	if _, err := root.Link(ctx, &fuse.LinkRequest{NewName: "c"}, fb); err != nil {
+		t.Fatal(err)
+	}
+
+	renameTest(t, root, "a", root, "b")
+	if got, want := names(root), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("names after rename = %v", got)
+	}
+	if !bytes.Equal(readFile(t, lookupTest(t, root, "b").(*File)), a) {
+		t.Fatalf("renamed file read back wrong data")
+	}
+	c := lookupTest(t, root, "c").(*File)
+	if !bytes.Equal(readFile(t, c), b) || c.attr.Nlink != 1 {
+		t.Fatalf("other link of the replaced file lost its data or has nlink %d", c.attr.Nlink)
+	}
+	if i, err := fs.meta.GetInode(c.id); err != nil || i.Nlink != 1 || i.Key != "c" {
+		t.Fatalf("replaced inode = %+v, %v", i, err)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	store := mem.NewMemClient("t")
+	datapath := t.TempDir()
+	fs := mountTest(t, store, datapath, false, true, "")
+	root := rootDir(fs)
+	target := "../some dir/f%"
+	n, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "l", Target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attr fuse.Attr
+	if err := n.(*File).Attr(ctx, &attr); err != nil || attr.Mode != os.ModeSymlink|0777 || attr.Size != uint64(len(target)) {
+		t.Fatalf("symlink attr = %+v, %v", attr, err)
+	}
+	if o, err := store.Head("l"); err != nil || o.Size != 0 || o.Metadata[SymlinkKey] == "" {
+		t.Fatalf("mirrored symlink = %+v, %v", o, err)
+	}
+	renameTest(t, root, "l", root, "m")
+	fs.meta.Close()
+
+	fs = mountTest(t, store, datapath, false, true, "")
+	l := lookupTest(t, rootDir(fs), "m").(*File)
+	if got, err := l.Readlink(ctx, &fuse.ReadlinkRequest{}); err != nil || got != target {
+		t.Fatalf("Readlink after reload = %q, %v", got, err)
+	}
+	if got := fs.symlinkTarget("m"); got != target {
+		t.Fatalf("renamed mirror has target %q", got)
+	}
+}
+
+func TestHardLink(t *testing.T) {
+	store := mem.NewMemClient("t")
+	datapath := t.TempDir()
+	fs := mountTest(t, store, datapath, false, true, "")
+	root := rootDir(fs)
+	d := mkdirTest(t, root, "d")
+	data := testData(5000, 6)
+	f := writeFile(t, root, "a", data)
+	if _, err := d.Link(ctx, &fuse.LinkRequest{NewName: "b"}, f); err != nil {
+		t.Fatal(err)
+	}
+	if f.attr.Nlink != 2 {
+		t.Fatalf("nlink after link = %d", f.attr.Nlink)
+	}
+	b := lookupTest(t, d, "b").(*File)
+	if b.Inode != f.Inode || !bytes.Equal(readFile(t, b), data) {
+		t.Fatalf("link does not share the inode and data of the file")
+	}
+
+	// unlinking the name that holds the data keeps unflushed writes
+	h := openTest(t, b, fuse.OpenReadWrite)
+	writeTest(t, h, []byte("new"), 100)
+	copy(data[100:], "new")
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTest(t, h, 0, len(data)); !bytes.Equal(got, data) {
+		t.Fatalf("open handle read back wrong data after unlink")
+	}
+	flushTest(t, h)
+	releaseTest(t, h)
+	if b.attr.Nlink != 1 || b.key != "d/b" {
+		t.Fatalf("after unlink nlink = %d, key = %q", b.attr.Nlink, b.key)
+	}
+	if _, err := store.Head("a"); err == nil {
+		t.Fatalf("data left under the unlinked name")
+	}
+	fs.meta.Close()
+
+	fs = mountTest(t, store, datapath, false, true, "")
+	d = lookupTest(t, rootDir(fs), "d").(*Dir)
+	b = lookupTest(t, d, "b").(*File)
+	if b.attr.Nlink != 1 || !bytes.Equal(readFile(t, b), data) {
+		t.Fatalf("link after reload has nlink %d or wrong data", b.attr.Nlink)
+	}
+	if err := d.Remove(ctx, &fuse.RemoveRequest{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if objs, _ := store.List(""); len(objs) != 1 || objs[0].Key != "d/" {
+		t.Fatalf("objects left after the last unlink: %+v", objs)
+	}
+	if _, err := fs.meta.GetInode(b.id); err == nil {
+		t.Fatalf("inode left after the last unlink")
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), false, true, "")
+	root := rootDir(fs)
+	d := mkdirTest(t, root, "d")
+	if _, err := root.Link(ctx, &fuse.LinkRequest{NewName: "e"}, d); err == nil {
+		t.Fatalf("hard link of a directory succeeded")
+	}
+}
@@ -0,0 +1,263 @@
+package fuse
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DiskCacheSize is the default size of the disk cache.
+	DiskCacheSize = 1 << 34
+
+	diskChunkDir  = "chunks"
+	diskObjectDir = "objects"
+	diskTempFile  = ".tmp-"
+)
+
+// diskCache keeps downloaded chunks and blocks of plain objects in a local
+// directory, so that they survive remounts. Every entry starts with the
+// sha256 of its data, which is checked when it is read back, a chunk is
+// also checked against the hash in its layout. The least recently used
+// entries are removed when the cache is full. A nil diskCache caches
+// nothing.
+type diskCache struct {
+	sync.Mutex
+	dir     string
+	used    int64
+	limit   int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type diskEntry struct {
+	path string
+	size int64
+}
+
+// openDiskCache opens the cache in dir, the entries left by earlier mounts
+// are kept in the order they were last used.
+func openDiskCache(dir string, limit int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &diskCache{
+		dir:     dir,
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	type found struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var files []found
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), diskTempFile) {
+			return os.Remove(path)
+		}
+		files = append(files, found{path: path, size: info.Size(), mtime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mtime.Before(files[j].mtime)
+	})
+	for _, f := range files {
+		c.entries[f.path] = c.lru.PushFront(&diskEntry{path: f.path, size: f.size})
+		c.used += f.size
+	}
+	c.Lock()
+	c.evict()
+	c.Unlock()
+	return c, nil
+}
+
+func (c *diskCache) chunkPath(hash string) string {
+	return filepath.Join(c.dir, diskChunkDir, hash[:2], hash)
+}
+
+// objectDir holds the blocks of the object key, version names the stored
+// data of the object so that blocks of older data are never read.
+func (c *diskCache) objectDir(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, diskObjectDir, hex.EncodeToString(sum[:]))
+}
+
+func (c *diskCache) blockPath(key, version string, index int64) string {
+	return filepath.Join(c.objectDir(key), version+"-"+strconv.FormatInt(index, 10))
+}
+
+// get fills buf with the entry at path. want is the hex sha256 the data
+// must have, or empty when only the stored sha256 is checked.
+func (c *diskCache) get(path, want string, buf []byte) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	el := c.entries[path]
+	c.Unlock()
+	if el == nil {
+		return false
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil || len(b) != sha256.Size+len(buf) {
+		c.remove(path)
+		return false
+	}
+	sum := sha256.Sum256(b[sha256.Size:])
+	if !bytes.Equal(sum[:], b[:sha256.Size]) || (want != "" && hex.EncodeToString(sum[:]) != want) {
+		klog.Errorf("Disk cache entry %v is corrupt", path)
+		c.remove(path)
+		return false
+	}
+	copy(buf, b[sha256.Size:])
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	c.Lock()
+	if el := c.entries[path]; el != nil {
+		c.lru.MoveToFront(el)
+	}
+	c.Unlock()
+	return true
+}
+
+// put stores data as the entry at path, want is as for get.
+func (c *diskCache) put(path, want string, data []byte) {
+	if c == nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	if want != "" && hex.EncodeToString(sum[:]) != want {
+		klog.Errorf("Data for disk cache entry %v does not match %v", path, want)
+		return
+	}
+	if err := c.write(path, sum[:], data); err != nil {
+		klog.Errorf("Write disk cache entry %v error %v", path, err)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if el := c.entries[path]; el != nil {
+		c.used -= c.lru.Remove(el).(*diskEntry).size
+	}
+	size := int64(sha256.Size + len(data))
+	c.entries[path] = c.lru.PushFront(&diskEntry{path: path, size: size})
+	c.used += size
+	c.evict()
+}
+
+// write replaces the file at path in one step, so that a crash never
+// leaves a partial entry.
+func (c *diskCache) write(path string, sum, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, diskTempFile)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(sum)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (c *diskCache) evict() {
+	for c.used > c.limit && c.lru.Len() > 0 {
+		e := c.lru.Remove(c.lru.Back()).(*diskEntry)
+		delete(c.entries, e.path)
+		c.used -= e.size
+		if err := os.Remove(e.path); err != nil {
+			klog.Errorf("Remove disk cache entry %v error %v", e.path, err)
+		}
+	}
+}
+
+func (c *diskCache) remove(path string) {
+	c.Lock()
+	defer c.Unlock()
+	if el := c.entries[path]; el != nil {
+		c.used -= c.lru.Remove(el).(*diskEntry).size
+		delete(c.entries, path)
+	}
+	os.Remove(path)
+}
+
+// getBlocks fills buf with the blocks of the object key at off, a multiple
+// of CacheBlockSize, when all of them are cached.
+func (c *diskCache) getBlocks(key, version string, off int64, buf []byte) bool {
+	if c == nil {
+		return false
+	}
+	for pos := int64(0); pos < int64(len(buf)); pos += CacheBlockSize {
+		end := pos + CacheBlockSize
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+		if !c.get(c.blockPath(key, version, (off+pos)/CacheBlockSize), "", buf[pos:end]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *diskCache) putBlocks(key, version string, off int64, buf []byte) {
+	if c == nil {
+		return
+	}
+	for pos := int64(0); pos < int64(len(buf)); pos += CacheBlockSize {
+		end := pos + CacheBlockSize
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+		c.put(c.blockPath(key, version, (off+pos)/CacheBlockSize), "", buf[pos:end])
+	}
+}
+
+// invalidate removes the blocks of the object key, its data changed.
+func (c *diskCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	dir := c.objectDir(key)
+	c.Lock()
+	defer c.Unlock()
+	for path, el := range c.entries {
+		if filepath.Dir(path) == dir {
+			c.used -= c.lru.Remove(el).(*diskEntry).size
+			delete(c.entries, path)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		klog.Errorf("Remove disk cache of %v error %v", key, err)
+	}
+}
@@ -0,0 +1,134 @@
+package fuse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+func openDiskTest(t *testing.T, dir string, limit int64) *diskCache {
+	t.Helper()
+	c, err := openDiskCache(dir, limit)
+	if err != nil {
+		t.Fatalf("open disk cache %s: %v", dir, err)
+	}
+	return c
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	c := openDiskTest(t, dir, 1<<20)
+	data := testData(1000, 24)
+	hash := ID(sha256.Sum256(data)).String()
+	path := c.chunkPath(hash)
+	buf := make([]byte, len(data))
+	if c.get(path, hash, buf) {
+		t.Fatalf("empty cache returned an entry")
+	}
+	c.put(path, hash, data)
+	if !c.get(path, hash, buf) || !bytes.Equal(buf, data) {
+		t.Fatalf("cached chunk read back wrong")
+	}
+
+	// data not matching its hash is not stored
+	other := c.chunkPath(ID(sha256.Sum256([]byte("x"))).String())
+	c.put(other, ID(sha256.Sum256([]byte("x"))).String(), data)
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Fatalf("chunk stored under the wrong hash")
+	}
+
+	// a corrupt entry is dropped
+	b, _ := ioutil.ReadFile(path)
+	b[len(b)-1]++
+	ioutil.WriteFile(path, b, 0600)
+	if c.get(path, hash, buf) {
+		t.Fatalf("corrupt entry was returned")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) || c.used != 0 {
+		t.Fatalf("corrupt entry was kept")
+	}
+
+	// blocks of an object are read back only for their version
+	c.putBlocks("k", "v1", CacheBlockSize, data)
+	if !c.getBlocks("k", "v1", CacheBlockSize, buf) || !bytes.Equal(buf, data) {
+		t.Fatalf("cached block read back wrong")
+	}
+	if c.getBlocks("k", "v2", CacheBlockSize, buf) || c.getBlocks("k", "v1", 0, buf) {
+		t.Fatalf("block of another version or offset was returned")
+	}
+	c.invalidate("k")
+	if c.getBlocks("k", "v1", CacheBlockSize, buf) || c.used != 0 {
+		t.Fatalf("invalidated block was kept")
+	}
+}
+
+func TestDiskCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	entry := int64(sha256.Size + 1000)
+	c := openDiskTest(t, dir, 3*entry)
+	buf := make([]byte, 1000)
+	var paths []string
+	for i := 0; i < 3; i++ {
+		paths = append(paths, filepath.Join(dir, "e", fmt.Sprint(i)))
+		c.put(paths[i], "", testData(1000, int64(i)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	// entry 0 is used again, entry 1 goes first
+	c.get(paths[0], "", buf)
+	time.Sleep(10 * time.Millisecond)
+	paths = append(paths, filepath.Join(dir, "e", "3"))
+	c.put(paths[3], "", testData(1000, 3))
+	if c.get(paths[1], "", buf) {
+		t.Fatalf("least recently used entry was kept")
+	}
+	if c.used != 3*entry {
+		t.Fatalf("cache holds %d bytes, want %d", c.used, 3*entry)
+	}
+
+	// a reopen keeps the entries in the order they were used and removes
+	// partial writes
+	ioutil.WriteFile(filepath.Join(dir, "e", diskTempFile+"1"), []byte("partial"), 0600)
+	c = openDiskTest(t, dir, 2*entry)
+	if _, err := os.Stat(filepath.Join(dir, "e", diskTempFile+"1")); !os.IsNotExist(err) {
+		t.Fatalf("partial write was kept")
+	}
+	if c.get(paths[2], "", buf) {
+		t.Fatalf("least recently used entry was kept over the new limit")
+	}
+	for _, p := range []string{paths[0], paths[3]} {
+		if !c.get(p, "", buf) {
+			t.Fatalf("entry %s was lost on reopen", p)
+		}
+	}
+}
+
+func TestDiskCacheRemount(t *testing.T) {
+	for _, chunk := range []bool{false, true} {
+		store := mem.NewMemClient("t")
+		datapath, cache := t.TempDir(), t.TempDir()
+		fs := mountTest(t, store, datapath, chunk, true, "")
+		fs.disk = openDiskTest(t, cache, DiskCacheSize)
+		data := testData(ChunkCacheFixedSize+1000, 25)
+		f := writeFile(t, rootDir(fs), "f", data)
+		readFile(t, f)
+		fs.meta.Close()
+
+		// the data is read from the cache of the earlier mount
+		fs = mountTest(t, store, datapath, chunk, true, "")
+		fs.disk = openDiskTest(t, cache, DiskCacheSize)
+		f = lookupTest(t, rootDir(fs), "f").(*File)
+		store.SetFaults(mem.Faults{TruncateGet: 1})
+		if !bytes.Equal(readFile(t, f), data) {
+			t.Fatalf("chunk=%v: read after remount went to the bucket", chunk)
+		}
+		store.SetFaults(mem.Faults{})
+		fs.meta.Close()
+	}
+}
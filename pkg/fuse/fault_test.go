@@ -0,0 +1,123 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+type chunking struct {
+	fixed    bool
+	compress string
+}
+
+func (c chunking) String() string {
+	return fmt.Sprintf("fixed=%v,compress=%q", c.fixed, c.compress)
+}
+
+var chunkings = []chunking{{true, ""}, {false, ""}, {true, "lz4"}}
+
+func TestWriterAtFlushFault(t *testing.T) {
+	store := mem.NewMemClient("t")
+	fs := mountTest(t, store, t.TempDir(), false, true, "")
+	f, h := createTest(t, rootDir(fs), "f")
+	store.SetFaults(mem.Faults{FailUploadPart: 2})
+	data := testData(2*UploadPartSize+1000, 1)
+	werr := writeData(h, data, 0)
+	ferr := h.Flush(ctx, &fuse.FlushRequest{})
+	if werr == nil && ferr == nil {
+		t.Fatalf("write and flush succeeded with a failing part")
+	}
+	releaseTest(t, h)
+	if o, err := store.Head("f"); err != nil || o.Size != 0 {
+		t.Fatalf("failed upload left %+v, %v", o, err)
+	}
+	if n := store.Uploads(); n != 0 {
+		t.Fatalf("failed upload left %d multipart uploads", n)
+	}
+
+	store.SetFaults(mem.Faults{})
+	h = openTest(t, f, fuse.OpenReadWrite|fuse.OpenTruncate)
+	writeTest(t, h, data, 0)
+	flushTest(t, h)
+	releaseTest(t, h)
+	if !bytes.Equal(readFile(t, f), data) {
+		t.Fatalf("write after a failed upload read back wrong data")
+	}
+}
+
+func TestChunkWriterUploadFault(t *testing.T) {
+	for _, c := range chunkings {
+		t.Run(c.String(), func(t *testing.T) {
+			store := mem.NewMemClient("t")
+			fs := mountTest(t, store, t.TempDir(), true, c.fixed, c.compress)
+			f, h := createTest(t, rootDir(fs), "f")
+			store.SetFaults(mem.Faults{FailPut: 2})
+			data := testData(3*ChunkCacheDynamicReadSize, 2)
+			werr := writeData(h, data, 0)
+			ferr := h.Flush(ctx, &fuse.FlushRequest{})
+			if werr == nil && ferr == nil {
+				t.Fatalf("write and flush succeeded with a failing chunk")
+			}
+			releaseTest(t, h)
+			if _, err := store.Head("f" + metaSuffix); err == nil {
+				t.Fatalf("failed upload stored a chunk layout")
+			}
+			if i, err := fs.meta.GetInode(f.id); err != nil || len(i.Layout) != 0 {
+				t.Fatalf("failed upload recorded a chunk layout: %v", err)
+			}
+
+			store.SetFaults(mem.Faults{})
+			h = openTest(t, f, fuse.OpenReadWrite|fuse.OpenTruncate)
+			writeTest(t, h, data, 0)
+			flushTest(t, h)
+			releaseTest(t, h)
+			if !bytes.Equal(readFile(t, f), data) {
+				t.Fatalf("write after a failed upload read back wrong data")
+			}
+		})
+	}
+}
+
+func TestReaderDownloadFault(t *testing.T) {
+	modes := append([]chunking(nil), chunkings...)
+	for _, c := range append(modes, chunking{}) {
+		chunk := c != chunking{}
+		t.Run(fmt.Sprintf("chunk=%v,%v", chunk, c), func(t *testing.T) {
+			store := mem.NewMemClient("t")
+			fs := mountTest(t, store, t.TempDir(), chunk, c.fixed, c.compress)
+			data := testData(ChunkCacheFixedSize+1000, 3)
+			f := writeFile(t, rootDir(fs), "f", data)
+
+			store.SetFaults(mem.Faults{TruncateGet: 1000})
+			h := openTest(t, f, fuse.OpenReadOnly)
+			resp := &fuse.ReadResponse{Data: make([]byte, 0, 128<<10)}
+			if err := h.Read(ctx, &fuse.ReadRequest{Size: 128 << 10}, resp); err == nil {
+				t.Fatalf("read of truncated data succeeded")
+			}
+			releaseTest(t, h)
+
+			// nothing of the truncated data was cached
+			store.SetFaults(mem.Faults{})
+			if !bytes.Equal(readFile(t, f), data) {
+				t.Fatalf("read after a failed download read back wrong data")
+			}
+		})
+	}
+}
+
+func TestReaderHeadFault(t *testing.T) {
+	store := mem.NewMemClient("t")
+	fs := mountTest(t, store, t.TempDir(), false, true, "")
+	f := writeFile(t, rootDir(fs), "f", testData(1000, 4))
+	store.SetFaults(mem.Faults{HeadNotFound: true})
+	h := openTest(t, f, fuse.OpenReadOnly)
+	defer releaseTest(t, h)
+	resp := &fuse.ReadResponse{Data: make([]byte, 0, 1000)}
+	if err := h.Read(ctx, &fuse.ReadRequest{Size: 1000}, resp); err == nil {
+		t.Fatalf("read of a missing object succeeded")
+	}
+}
@@ -2,18 +2,25 @@ package fuse
 
 import (
 	"context"
+	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/nevermore/muyifs/pkg/meta"
 )
 
+const (
+	// SymlinkKey is the object metadata holding the escaped target of a
+	// symlink, mirrored on the backend so that other mounts can see it.
+	SymlinkKey = "symlink"
+)
+
+// File is a link to a file, all links of the same file share its Inode.
 type File struct {
-	id     uint64
+	*Inode
 	parent *Dir
 	name   string
-	typ    fuse.DirentType
-	attr   *fuse.Attr
-	fs     *FileSystem
 }
 
 func (f *File) Attr(ctx context.Context, attr *fuse.Attr) (err error) {
@@ -29,16 +36,37 @@ func (f *File) Attr(ctx context.Context, attr *fuse.Attr) (err error) {
 }
 
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	f.fs.Lock()
-	h := f.fs.handler[f.id]
-	f.fs.Unlock()
-	resp.Handle = fuse.HandleID(f.id)
+	h := f.fs.openHandle(f, req.Uid, req.Gid, req.Flags)
+	if req.Flags&fuse.OpenTruncate != 0 && !req.Flags.IsReadOnly() && f.attr.Size > 0 {
+		if err := f.truncate(0); err != nil {
+			h.Release(ctx, &fuse.ReleaseRequest{})
+			return nil, err
+		}
+		f.attr.Mtime = time.Now()
+		f.attr.Ctime = f.attr.Mtime
+		if err := f.save(); err != nil {
+			h.Release(ctx, &fuse.ReleaseRequest{})
+			return nil, err
+		}
+	}
+	resp.Handle = fuse.HandleID(h.ID)
 	return h, nil
 }
 
+func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if f.typ != fuse.DT_Link {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return f.target, nil
+}
+
 func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	if req.Valid.Size() {
-		f.attr.Size = req.Size
+	if req.Valid.Size() && req.Size != f.attr.Size {
+		if err := f.truncate(req.Size); err != nil {
+			return err
+		}
+		f.attr.Mtime = time.Now()
+		f.attr.Ctime = f.attr.Mtime
 	}
 	if req.Valid.Mode() {
 		f.attr.Mode = req.Mode
@@ -61,5 +89,48 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	resp.Attr.Gid = f.attr.Gid
 	resp.Attr.Atime = f.attr.Atime
 	resp.Attr.Mtime = f.attr.Mtime
-	return nil
+	return f.save()
+}
+
+func (f *File) save() error {
+	return f.fs.meta.Update(f.id, func(i *meta.Inode) {
+		setInode(i, f.attr)
+		i.Key = f.key
+	})
+}
+
+func (f *File) path() string {
+	return f.parent.String() + f.name
+}
+
+// dataKey returns the object key holding the data of f.
+func (f *File) dataKey() string {
+	if f.key != "" {
+		return f.key
+	}
+	return f.path()
+}
+
+// isChunked tells whether the data stored at key is split into chunks,
+// which is the case when it has a layout. An empty file follows the mount.
+func (f *File) isChunked(key string) bool {
+	if i, err := f.fs.meta.GetInode(f.id); err == nil && len(i.Layout) > 0 {
+		return true
+	}
+	if f.attr.Size == 0 {
+		return f.fs.chunk
+	}
+	_, err := f.fs.Backend.Head(key + metaSuffix)
+	return err == nil
+}
+
+// reopen points the open handles of f at the current key of the file. The
+// caller holds the open state of f, see lockOpen.
+func (f *File) reopen() {
+	f.fs.Lock()
+	of := f.fs.files[f.id]
+	f.fs.Unlock()
+	if of != nil {
+		of.open(f.dataKey())
+	}
 }
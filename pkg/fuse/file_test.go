@@ -0,0 +1,58 @@
+package fuse
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+func TestOpenAfterRemount(t *testing.T) {
+	for _, chunk := range []bool{false, true} {
+		store := mem.NewMemClient("t")
+		datapath := t.TempDir()
+		fs := mountTest(t, store, datapath, chunk, true, "")
+		data := testData(ChunkCacheFixedSize+1000, 17)
+		writeFile(t, rootDir(fs), "f", data)
+		fs.meta.Close()
+
+		// A mount in the other mode reads what is stored, with the
+		// metadata and rebuilt from the bucket.
+		for _, dp := range []string{datapath, t.TempDir()} {
+			fs = mountTest(t, store, dp, !chunk, true, "")
+			f := lookupTest(t, rootDir(fs), "f").(*File)
+			h := openTest(t, f, fuse.OpenReadOnly)
+			if got := readTest(t, h, 0, len(data)); !bytes.Equal(got, data) {
+				t.Fatalf("chunk=%v: read after remount read back wrong data", chunk)
+			}
+			err := h.Write(ctx, &fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{})
+			if err != fuse.Errno(syscall.EBADF) {
+				t.Fatalf("chunk=%v: write to a read-only handle = %v", chunk, err)
+			}
+			releaseTest(t, h)
+
+			h = openTest(t, f, fuse.OpenWriteOnly)
+			resp := &fuse.ReadResponse{Data: make([]byte, 0, 10)}
+			if err := h.Read(ctx, &fuse.ReadRequest{Size: 10}, resp); err != fuse.Errno(syscall.EBADF) {
+				t.Fatalf("chunk=%v: read from a write-only handle = %v", chunk, err)
+			}
+			releaseTest(t, h)
+			fs.meta.Close()
+		}
+
+		fs = mountTest(t, store, datapath, chunk, true, "")
+		f := lookupTest(t, rootDir(fs), "f").(*File)
+		h := openTest(t, f, fuse.OpenReadWrite|fuse.OpenTruncate)
+		if f.attr.Size != 0 {
+			t.Fatalf("chunk=%v: size after O_TRUNC = %d", chunk, f.attr.Size)
+		}
+		writeTest(t, h, []byte("new"), 0)
+		flushTest(t, h)
+		releaseTest(t, h)
+		if got := readFile(t, f); string(got) != "new" {
+			t.Fatalf("chunk=%v: rewritten file read back %q", chunk, got)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package fuse
 import (
 	"context"
 	"io"
+	"sort"
 	"sync"
 	"syscall"
 
@@ -10,29 +11,178 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// FileHandle is one open of a file. It keeps its own read state, the
+// writer is shared with the other handles of the file through openFile.
 type FileHandle struct {
 	sync.Mutex
-	ID     uint64
-	Uid    uint32
-	Gid    uint32
-	f      *File
+	ID    uint64
+	Uid   uint32
+	Gid   uint32
+	flags fuse.OpenFlags
+	f     *File
+	of    *openFile
+	// reader was built for key and the data generation gen of of.
+	reader  CommonReader
+	key     string
+	chunked bool
+	gen     uint64
+}
+
+// openFile is the state of an open inode shared by all of its handles.
+type openFile struct {
+	sync.Mutex
+	f    *File
+	refs int
+	key  string
+	// chunked is whether the data of f is stored as chunks.
+	chunked bool
+	// gen changes whenever the stored data changes.
+	gen    uint64
 	reader CommonReader
-	writer CommonWriter
+	writer *StagingWriter
 }
 
 const (
 	CacheSize = 1 << 26
 )
 
-func NewFileHandle(f *File, uid, gid uint32) *FileHandle {
-	return &FileHandle{
-		Uid: uid,
-		Gid: gid,
-		f:   f,
+// openHandle returns a new handle of f, sharing the inode state with the
+// other open handles of f.
+func (fs *FileSystem) openHandle(f *File, uid, gid uint32, flags fuse.OpenFlags) *FileHandle {
+	fs.Lock()
+	of := fs.files[f.id]
+	fs.Unlock()
+	if of == nil {
+		of = &openFile{f: f}
+		of.open(f.dataKey())
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	if old := fs.files[f.id]; old != nil {
+		of = old
+	} else {
+		fs.files[f.id] = of
+	}
+	of.refs++
+	fs.nextHandle++
+	h := &FileHandle{
+		ID:    fs.nextHandle,
+		Uid:   uid,
+		Gid:   gid,
+		flags: flags,
+		f:     f,
+		of:    of,
+	}
+	fs.handler[h.ID] = h
+	return h
+}
+
+func (fs *FileSystem) newReader(ino uint64, key string, chunked bool) CommonReader {
+	if chunked {
+		return NewChunkReader(ino, key, fs, fs.compress, fs.isFixed)
+	}
+	return NewReader(key, fs)
+}
+
+// open sets up the shared reader and writer for the object key, releasing
+// the ones it had before. Pending writes have to be flushed first.
+func (of *openFile) open(key string) {
+	if of.writer != nil {
+		of.writer.Release()
+		of.reader.Release()
+	}
+	fs := of.f.fs
+	ino := of.f.id
+	of.key = key
+	of.chunked = of.f.isChunked(key)
+	of.reader = fs.newReader(ino, key, of.chunked)
+	var newWriter func(base int64) (CommonWriter, error)
+	if of.chunked {
+		newWriter = func(base int64) (CommonWriter, error) {
+			w := NewChunkWriter(ino, key, fs, fs.compress, fs.isFixed).(*ChunkWriter)
+			return w, w.appendTo(base)
+		}
+	} else {
+		newWriter = func(base int64) (CommonWriter, error) {
+			w := NewWriter(key, fs).(*WriterAt)
+			w.appendTo(base)
+			return w, nil
+		}
+	}
+	of.writer = NewStagingWriter(of.f, of.reader, newWriter)
+	of.gen++
+}
+
+// flush stores the pending writes of the file.
+func (of *openFile) flush() error {
+	if !of.writer.pending() {
+		return nil
+	}
+	err := of.writer.Flush()
+	of.gen++
+	return err
+}
+
+// lockOpen locks the open state of files and flushes their pending writes,
+// so that their objects can be moved. The returned func unlocks them.
+func (fs *FileSystem) lockOpen(files []*File) (func(), error) {
+	var ofs []*openFile
+	fs.Lock()
+	for _, f := range files {
+		if of := fs.files[f.id]; of != nil {
+			ofs = append(ofs, of)
+		}
+	}
+	fs.Unlock()
+	// a fixed order, and every inode once
+	sort.Slice(ofs, func(i, j int) bool { return ofs[i].f.id < ofs[j].f.id })
+	n := 0
+	for i, of := range ofs {
+		if i == 0 || of != ofs[i-1] {
+			ofs[n] = of
+			n++
+		}
+	}
+	ofs = ofs[:n]
+
+	unlock := func(ofs []*openFile) {
+		for _, of := range ofs {
+			of.Unlock()
+		}
+	}
+	for i, of := range ofs {
+		of.Lock()
+		if err := of.flush(); err != nil {
+			unlock(ofs[:i+1])
+			return nil, err
+		}
 	}
+	return func() { unlock(ofs) }, nil
+}
+
+// sync makes the reader of the handle follow the stored data.
+func (fh *FileHandle) sync() {
+	of := fh.of
+	of.Lock()
+	key, chunked, gen := of.key, of.chunked, of.gen
+	of.Unlock()
+	if fh.reader != nil && fh.gen == gen {
+		return
+	}
+	if fh.reader != nil {
+		fh.reader.Release()
+	}
+	if fh.reader == nil || fh.key != key || fh.chunked != chunked {
+		fh.reader = fh.f.fs.newReader(fh.f.id, key, chunked)
+	}
+	fh.key, fh.chunked, fh.gen = key, chunked, gen
 }
 
 func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if fh.flags.IsWriteOnly() {
+		return fuse.Errno(syscall.EBADF)
+	}
 	fh.Lock()
 	defer fh.Unlock()
 
@@ -46,7 +196,26 @@ func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fus
 		buff = make([]byte, req.Size)
 	}
 
-	totalRead, err := fh.reader.ReadAt(buff, req.Offset)
+	var totalRead int
+	var err error
+	of := fh.of
+	of.Lock()
+	if of.writer.streaming() {
+		if err := of.flush(); err != nil {
+			of.Unlock()
+			klog.Errorf("Flush %v before read error %v", of.key, err)
+			return fuse.Errno(syscall.EIO)
+		}
+	}
+	if of.writer.staged() {
+		// unflushed writes are only in the staging file
+		totalRead, err = of.writer.ReadAt(buff[:req.Size], req.Offset)
+		of.Unlock()
+	} else {
+		of.Unlock()
+		fh.sync()
+		totalRead, err = fh.reader.ReadAt(buff, req.Offset)
+	}
 	if err != nil && err != io.EOF {
 		klog.Errorf("FileHandle ReadAt error %v", err)
 		return fuse.Errno(syscall.EIO)
@@ -63,29 +232,61 @@ func max(x, y uint64) uint64 {
 }
 
 func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	fh.Lock()
-	defer fh.Unlock()
+	if fh.flags.IsReadOnly() {
+		return fuse.Errno(syscall.EBADF)
+	}
+	of := fh.of
+	of.Lock()
+	defer of.Unlock()
 
-	n, err := fh.writer.WriteAt(req.Data, req.Offset)
+	off := req.Offset
+	if fh.flags&fuse.OpenAppend != 0 {
+		off = int64(fh.f.attr.Size)
+	}
+	n, err := of.writer.WriteAt(req.Data, off)
 	if err != nil {
 		klog.Errorf("Write buffer error %v", err)
 		return err
 	}
-	fh.f.attr.Size = max(fh.f.attr.Size, uint64(req.Offset+int64(n)))
+	fh.f.attr.Size = max(fh.f.attr.Size, uint64(off+int64(n)))
 	resp.Size = n
 	return nil
 }
 
 func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	fh.Lock()
-	defer fh.Unlock()
-	return fh.writer.Flush()
+	of := fh.of
+	of.Lock()
+	defer of.Unlock()
+	if err := of.flush(); err != nil {
+		return err
+	}
+	return fh.f.save()
 }
 
+// Release drops the handle, the shared state goes with the last handle of
+// the file.
 func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	fh.Lock()
 	defer fh.Unlock()
-	fh.writer.Release()
-	fh.reader.Release()
+	if fh.reader != nil {
+		fh.reader.Release()
+	}
+
+	fs := fh.f.fs
+	of := fh.of
+	fs.Lock()
+	delete(fs.handler, fh.ID)
+	of.refs--
+	last := of.refs == 0
+	if last && fs.files[fh.f.id] == of {
+		delete(fs.files, fh.f.id)
+	}
+	fs.Unlock()
+	if last {
+		of.Lock()
+		of.writer.Release()
+		of.reader.Release()
+		of.Unlock()
+	}
 	return nil
 }
@@ -0,0 +1,72 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+func TestHandlesReadIndependently(t *testing.T) {
+	for _, c := range append([]chunking{{}}, chunkings...) {
+		chunk := c != chunking{}
+		t.Run(fmt.Sprintf("chunk=%v,%v", chunk, c), func(t *testing.T) {
+			fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), chunk, c.fixed, c.compress)
+			data := testData(3*ChunkCacheFixedSize, 18)
+			f := writeFile(t, rootDir(fs), "f", data)
+
+			a := openTest(t, f, fuse.OpenReadOnly)
+			b := openTest(t, f, fuse.OpenReadOnly)
+			if a.ID == b.ID || a.of != b.of {
+				t.Fatalf("handles %d and %d do not share the open file", a.ID, b.ID)
+			}
+			// two sequential readers far apart
+			step := 128 << 10
+			for off := 0; off < ChunkCacheFixedSize; off += step {
+				for _, r := range []struct {
+					h   *FileHandle
+					off int
+				}{{a, off}, {b, off + 2*ChunkCacheFixedSize}} {
+					got := readTest(t, r.h, int64(r.off), step)
+					if !bytes.Equal(got, data[r.off:r.off+step]) {
+						t.Fatalf("handle %d read back wrong data at %d", r.h.ID, r.off)
+					}
+				}
+			}
+
+			releaseTest(t, a)
+			if got := readTest(t, b, 100, 1000); !bytes.Equal(got, data[100:1100]) {
+				t.Fatalf("read after another handle was released read back wrong data")
+			}
+			if len(fs.files) != 1 {
+				t.Fatalf("open file went away with a handle still open")
+			}
+			releaseTest(t, b)
+			if len(fs.files) != 0 || len(fs.handler) != 0 {
+				t.Fatalf("released handles left %d open files and %d handles", len(fs.files), len(fs.handler))
+			}
+		})
+	}
+}
+
+func TestHandleSeesFlushedWrites(t *testing.T) {
+	fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), false, true, "")
+	data := testData(5000, 19)
+	f := writeFile(t, rootDir(fs), "f", data)
+	r := openTest(t, f, fuse.OpenReadOnly)
+	defer releaseTest(t, r)
+	if got := readTest(t, r, 0, len(data)); !bytes.Equal(got, data) {
+		t.Fatalf("read back wrong data")
+	}
+
+	w := openTest(t, f, fuse.OpenWriteOnly)
+	writeTest(t, w, []byte("changed"), 100)
+	copy(data[100:], "changed")
+	flushTest(t, w)
+	releaseTest(t, w)
+	if got := readTest(t, r, 0, len(data)); !bytes.Equal(got, data) {
+		t.Fatalf("reader did not follow the flushed write")
+	}
+}
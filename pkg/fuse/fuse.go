@@ -1,8 +1,7 @@
 package fuse
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"os"
 	"sync"
 	"time"
@@ -11,68 +10,91 @@ import (
 	"bazil.org/fuse/fs"
 	_ "bazil.org/fuse/fs/fstestutil"
 	"github.com/nevermore/muyifs/pkg/backend"
-	"github.com/nevermore/muyifs/pkg/backend/obs"
-	"github.com/nevermore/muyifs/pkg/backend/s3"
+	"github.com/nevermore/muyifs/pkg/meta"
 	"k8s.io/klog/v2"
 )
 
 type FileSystem struct {
 	sync.Mutex
 	root     fs.Node
+	meta     *meta.Meta
+	datapath string
 	option   *Option
 	compress string
 	chunk    bool
 	isFixed  bool
-	handler  map[uint64]*FileHandle
-	Backend  backend.ObjectStorage
-	Server   *fs.Server
+	// handler holds the open handles by ID, files the state shared by the
+	// handles of an inode.
+	handler    map[uint64]*FileHandle
+	files      map[uint64]*openFile
+	nextHandle uint64
+	// readahead caps the memory of prefetched data.
+	readahead *budget
+	// blocks caches the data read by all open files.
+	blocks *blockCache
+	// disk is the optional read cache on local disk.
+	disk    *diskCache
+	Backend backend.ObjectStorage
+	Server  *fs.Server
 }
 
 type Option struct {
-	Backend   string
-	Bucket    string
-	Region    string
-	AccessKey string
-	SerectKey string
-	Endpoint  string
+	// Backend is the object storage spec, such as s3://bucket?region=r,
+	// obs://bucket or file:///path, see backend.New.
+	Backend string
+	// Readahead is the memory in bytes for data read ahead of sequential
+	// reads, 0 means ReadaheadBudget.
+	Readahead int64
+	// MemCacheSize is the memory in bytes of the block cache shared by all
+	// open files, 0 means BlockCacheSize.
+	MemCacheSize int64
+	// CacheDir is the directory of the read cache on local disk, there is
+	// none when it is empty. CacheSize is its size in bytes, 0 means
+	// DiskCacheSize.
+	CacheDir  string
+	CacheSize int64
 }
 
 func NewFileSystem(mountpoint, datapath, compress string, chunk, isFixed bool, option *Option) *FileSystem {
-	// root, err := reloadData(mountpoint, datapath)
-	// if err != nil {
-	// 	klog.Fatalf("Reload Metadata error %v", err)
-	// }
-	ts := time.Now()
-	root := &Dir{
-		id:     1,
-		parent: nil,
-		name:   mountpoint,
-		typ:    fuse.DT_Dir,
-		attr: &fuse.Attr{
-			Valid:     time.Second,
-			Inode:     1,
-			Size:      4 << 10,
-			Blocks:    0,
-			Atime:     ts,
-			Mtime:     ts,
-			Ctime:     ts,
-			Mode:      os.FileMode(0750),
-			Nlink:     2,
-			Uid:       0,
-			Gid:       0,
-			Rdev:      0,
-			BlockSize: 512,
-		},
+	m, err := meta.Open(datapath)
+	if err != nil {
+		klog.Fatalf("Open Metadata %s error %v", datapath, err)
+	}
+	if err := m.SetRefs(layoutRefs); err != nil {
+		klog.Fatalf("Count chunk references in %s error %v", datapath, err)
+	}
+	if err := removeStaging(datapath); err != nil {
+		klog.Errorf("Remove staging files in %s error %v", datapath, err)
 	}
 	f := &FileSystem{
-		root:     root,
+		meta:     m,
+		datapath: datapath,
 		compress: compress,
 		chunk:    chunk,
 		isFixed:  isFixed,
 		option:   option,
 		handler:  make(map[uint64]*FileHandle),
+		files:    make(map[uint64]*openFile),
+	}
+	limit := int64(ReadaheadBudget)
+	if option != nil && option.Readahead > 0 {
+		limit = option.Readahead
+	}
+	f.readahead = newBudget(limit)
+	size := int64(BlockCacheSize)
+	if option != nil && option.MemCacheSize > 0 {
+		size = option.MemCacheSize
+	}
+	f.blocks = newBlockCache(size)
+	if option != nil && option.CacheDir != "" {
+		size := int64(DiskCacheSize)
+		if option.CacheSize > 0 {
+			size = option.CacheSize
+		}
+		if f.disk, err = openDiskCache(option.CacheDir, size); err != nil {
+			klog.Fatalf("Open cache dir %s error %v", option.CacheDir, err)
+		}
 	}
-	root.fs = f
 	return f
 }
 
@@ -81,79 +103,127 @@ func (fs *FileSystem) Root() (fs.Node, error) {
 	return fs.root, nil
 }
 
-func reloadData(mountpoint, datapath string) (*Dir, error) {
-	_, err := os.Stat(datapath)
-	if err != nil && os.IsNotExist(err) {
+// reloadData loads the namespace from the metadata database. When there is
+// no local metadata the namespace is rebuilt from the objects in the bucket.
+func (fs *FileSystem) reloadData(mountpoint string) (*Dir, error) {
+	fresh := false
+	i, err := fs.meta.GetInode(meta.RootInode)
+	if err == meta.ErrNotFound {
+		fresh = true
 		ts := time.Now()
-		d := &Dir{
-			id:     1,
-			parent: nil,
-			name:   mountpoint,
-			typ:    fuse.DT_Dir,
-			attr: &fuse.Attr{
-				Valid:     time.Second,
-				Inode:     1,
-				Size:      4 << 10,
-				Blocks:    0,
-				Atime:     ts,
-				Mtime:     ts,
-				Ctime:     ts,
-				Mode:      os.FileMode(0750),
-				Nlink:     2,
-				Uid:       0,
-				Gid:       0,
-				Rdev:      0,
-				BlockSize: 512,
-			},
+		i = &meta.Inode{
+			Ino:   meta.RootInode,
+			Type:  uint32(fuse.DT_Dir),
+			Size:  4 << 10,
+			Atime: ts,
+			Mtime: ts,
+			Ctime: ts,
+			Mode:  os.FileMode(0750),
+			Nlink: 2,
 		}
-		b, err := json.Marshal(d)
-		if err != nil {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	root := &Dir{
+		id:     meta.RootInode,
+		parent: nil,
+		name:   mountpoint,
+		typ:    fuse.DT_Dir,
+		attr:   toAttr(i),
+		fs:     fs,
+	}
+	if fresh {
+		klog.Infof("No local metadata, rebuild namespace from %s", fs.Backend)
+		// The root inode is stored with the tree, an interrupted rebuild
+		// runs again.
+		if err := fs.rebuild(root, i); err != nil {
+			return nil, err
+		}
+		return root, nil
+	}
+	if err := fs.loadDir(root, make(map[uint64]*Inode)); err != nil {
+		return nil, err
+	}
+	// Entries stored before the name was reserved would collide with the
+	// chunks.
+	for _, d := range root.DirChild {
+		if err := checkReserved(d.name); err != nil {
 			return nil, err
 		}
-		if err = os.WriteFile(datapath, b, 0500); err != nil {
+	}
+	for _, f := range root.FileChild {
+		if err := checkReserved(f.name); err != nil {
 			return nil, err
 		}
-		return d, nil
 	}
-	f, err := os.Open(datapath)
+	return root, nil
+}
+
+// loadDir loads the entries of d, nodes collects the inodes of files so
+// that all hard links of a file share one Inode.
+func (fs *FileSystem) loadDir(d *Dir, nodes map[uint64]*Inode) error {
+	entries, err := fs.meta.ReadDir(d.id)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer f.Close()
-	content, err := ioutil.ReadAll(f)
-	var d Dir
-	err = json.Unmarshal(content, &d)
-	if err != nil {
-		return nil, err
+	for _, e := range entries {
+		i, err := fs.meta.GetInode(e.Ino)
+		if err != nil {
+			return fmt.Errorf("load inode %d of %s%s: %v", e.Ino, d.String(), e.Name, err)
+		}
+		typ := fuse.DirentType(i.Type)
+		if typ == fuse.DT_Dir {
+			dir := &Dir{
+				id:     i.Ino,
+				parent: d,
+				name:   e.Name,
+				typ:    typ,
+				attr:   toAttr(i),
+				fs:     fs,
+			}
+			if err := fs.loadDir(dir, nodes); err != nil {
+				return err
+			}
+			d.DirChild = append(d.DirChild, dir)
+			continue
+		}
+		node, ok := nodes[i.Ino]
+		if !ok {
+			node = &Inode{
+				id:     i.Ino,
+				typ:    typ,
+				attr:   toAttr(i),
+				fs:     fs,
+				target: i.Target,
+				key:    i.Key,
+			}
+			nodes[i.Ino] = node
+		}
+		d.FileChild = append(d.FileChild, newFile(d, e.Name, node))
 	}
-	return &d, nil
+	return nil
 }
 
 func Mount(mountpoint, datapath, compress string, chunk, isFixed bool, options *Option) {
 
 	muyifs := NewFileSystem(mountpoint, datapath, compress, chunk, isFixed, options)
-	switch options.Backend {
-	case "obs":
-		client, err := obs.NewObsClient(options.Bucket, options.Region, options.AccessKey, options.SerectKey, options.Endpoint)
-		if err != nil {
-			klog.Fatalf("Init OBS backend client error %v", err)
-		}
-		if err = client.Create(); err != nil {
-			klog.Fatalf("Create OBS backend bucket error %v", err)
-		}
-		muyifs.Backend = client
-	case "s3":
-		client, err := s3.NewS3Client(options.Bucket, options.Region, options.AccessKey, options.SerectKey, options.Endpoint)
-		if err != nil {
-			klog.Fatalf("Init S3 backend client error %v", err)
-		}
-		if err = client.Create(); err != nil {
-			klog.Fatalf("Create S3 backend bucket error %v", err)
-		}
-		muyifs.Backend = client
-	default:
-		klog.Fatalf("Unknown Backend %s", options.Backend)
+	defer muyifs.meta.Close()
+	client, err := backend.New(options.Backend)
+	if err != nil {
+		klog.Fatalf("Init backend client error %v", err)
+	}
+	if err = client.Create(); err != nil {
+		klog.Fatalf("Create %s backend error %v", client, err)
+	}
+	muyifs.Backend = client
+
+	root, err := muyifs.reloadData(mountpoint)
+	if err != nil {
+		klog.Fatalf("Reload Metadata error %v", err)
 	}
+	muyifs.root = root
 
 	opt := []fuse.MountOption{
 		fuse.FSName("muyifs"),
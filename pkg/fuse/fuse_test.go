@@ -0,0 +1,158 @@
+package fuse
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend"
+)
+
+var ctx = context.Background()
+
+// mountTest sets up a file system over store the way Mount does, without
+// serving it. datapath holds its metadata.
+func mountTest(t *testing.T, store backend.ObjectStorage, datapath string, chunk, fixed bool, compress string) *FileSystem {
+	t.Helper()
+	fs := NewFileSystem("/mnt", datapath, compress, chunk, fixed, &Option{})
+	t.Cleanup(func() { fs.meta.Close() })
+	fs.Backend = store
+	root, err := fs.reloadData("/mnt")
+	if err != nil {
+		t.Fatalf("reload metadata: %v", err)
+	}
+	fs.root = root
+	return fs
+}
+
+func rootDir(fs *FileSystem) *Dir {
+	return fs.root.(*Dir)
+}
+
+// testData returns n random bytes, the same for the same seed.
+func testData(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func createTest(t *testing.T, d *Dir, name string) (*File, *FileHandle) {
+	t.Helper()
+	req := &fuse.CreateRequest{Name: name, Mode: 0644, Flags: fuse.OpenReadWrite}
+	n, h, err := d.Create(ctx, req, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+	return n.(*File), h.(*FileHandle)
+}
+
+func openTest(t *testing.T, f *File, flags fuse.OpenFlags) *FileHandle {
+	t.Helper()
+	h, err := f.Open(ctx, &fuse.OpenRequest{Flags: flags}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("open %s: %v", f.name, err)
+	}
+	return h.(*FileHandle)
+}
+
+// writeData writes data at off in pieces of the size the kernel sends.
+func writeData(h *FileHandle, data []byte, off int64) error {
+	for len(data) > 0 {
+		n := 128 << 10
+		if n > len(data) {
+			n = len(data)
+		}
+		req := &fuse.WriteRequest{Data: data[:n], Offset: off}
+		if err := h.Write(ctx, req, &fuse.WriteResponse{}); err != nil {
+			return err
+		}
+		data, off = data[n:], off+int64(n)
+	}
+	return nil
+}
+
+func writeTest(t *testing.T, h *FileHandle, data []byte, off int64) {
+	t.Helper()
+	if err := writeData(h, data, off); err != nil {
+		t.Fatalf("write %s at %d: %v", h.f.name, off, err)
+	}
+}
+
+func flushTest(t *testing.T, h *FileHandle) {
+	t.Helper()
+	if err := h.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+		t.Fatalf("flush %s: %v", h.f.name, err)
+	}
+}
+
+func releaseTest(t *testing.T, h *FileHandle) {
+	t.Helper()
+	if err := h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("release %s: %v", h.f.name, err)
+	}
+}
+
+// readTest reads size bytes at off in pieces of the size the kernel asks
+// for, the result is short at the end of the file.
+func readTest(t *testing.T, h *FileHandle, off int64, size int) []byte {
+	t.Helper()
+	var out []byte
+	for size > 0 {
+		n := 128 << 10
+		if n > size {
+			n = size
+		}
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, n)}
+		if err := h.Read(ctx, &fuse.ReadRequest{Offset: off, Size: n}, resp); err != nil {
+			t.Fatalf("read %s at %d: %v", h.f.name, off, err)
+		}
+		out = append(out, resp.Data...)
+		if len(resp.Data) < n {
+			break
+		}
+		size, off = size-n, off+int64(n)
+	}
+	return out
+}
+
+// writeFile creates name in d with data and closes it.
+func writeFile(t *testing.T, d *Dir, name string, data []byte) *File {
+	t.Helper()
+	f, h := createTest(t, d, name)
+	writeTest(t, h, data, 0)
+	flushTest(t, h)
+	releaseTest(t, h)
+	return f
+}
+
+// readFile opens f and reads all of its data.
+func readFile(t *testing.T, f *File) []byte {
+	t.Helper()
+	h := openTest(t, f, fuse.OpenReadOnly)
+	defer releaseTest(t, h)
+	return readTest(t, h, 0, int(f.attr.Size))
+}
+
+func lookupTest(t *testing.T, d *Dir, name string) interface{} {
+	t.Helper()
+	n, err := d.Lookup(ctx, &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatalf("lookup %s in %q: %v", name, d.String(), err)
+	}
+	return n
+}
+
+// names returns the sorted names in d.
+func names(d *Dir) []string {
+	var s []string
+	for _, dd := range d.DirChild {
+		s = append(s, dd.name+"/")
+	}
+	for _, f := range d.FileChild {
+		s = append(s, f.name)
+	}
+	sort.Strings(s)
+	return s
+}
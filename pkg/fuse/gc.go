@@ -0,0 +1,130 @@
+package fuse
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+	"k8s.io/klog/v2"
+)
+
+// layoutRefs returns the shared chunks an encoded layout references, once
+// for every time it is used.
+func layoutRefs(layout []byte) []string {
+	m, err := decodeManifest(layout)
+	if err != nil {
+		klog.Errorf("Decode chunk layout error %v", err)
+		return nil
+	}
+	return chunkRefs(m.Chunks)
+}
+
+func chunkRefs(metas []ChunkMeta) []string {
+	var refs []string
+	for _, m := range metas {
+		if m.Start < m.End && !m.Hole && m.Hash != "" {
+			refs = append(refs, m.Hash)
+		}
+	}
+	return refs
+}
+
+// GCOption controls CollectGarbage.
+type GCOption struct {
+	// DryRun only reports the chunks that would be deleted.
+	DryRun bool
+	// Grace keeps unreferenced chunks stored less than Grace ago, the
+	// layout of a file that is being written is only stored at its flush.
+	Grace time.Duration
+	// Keep holds more chunks to keep, such as those counted in the
+	// metadata of a file system that is not mounted.
+	Keep map[string]uint64
+}
+
+// GCStats tells what CollectGarbage found.
+type GCStats struct {
+	Layouts    int
+	Chunks     int
+	Referenced int
+	Young      int
+	Deleted    int
+	// Freed is the size of the deleted chunks.
+	Freed int64
+}
+
+// CollectGarbage deletes the shared chunks that no chunk layout in the
+// bucket references. The chunks are listed before the layouts are read, so
+// a chunk stored meanwhile is never seen unreferenced, and chunks younger
+// than the grace period are kept for files still being written. A writer
+// that finds a chunk stored touches it, so every chunk is looked at again
+// right before it is deleted. report is called for every unreferenced
+// chunk.
+func CollectGarbage(store backend.ObjectStorage, opt GCOption, report func(o backend.Object)) (*GCStats, error) {
+	stats := &GCStats{}
+	start := time.Now()
+	chunks, err := store.List(chunkPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mark
+	marked := make(map[string]bool)
+	for hash := range opt.Keep {
+		marked[hash] = true
+	}
+	objs, err := store.List("")
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objs {
+		if !strings.HasSuffix(o.Key, metaSuffix) || strings.HasPrefix(o.Key, reservedPrefix) {
+			continue
+		}
+		m, err := getManifest(store, strings.TrimSuffix(o.Key, metaSuffix))
+		if err != nil {
+			// An unreadable layout may reference any chunk.
+			return nil, fmt.Errorf("read chunk layout %v: %v", o.Key, err)
+		}
+		for _, hash := range chunkRefs(m.Chunks) {
+			marked[hash] = true
+		}
+		stats.Layouts++
+	}
+
+	// Sweep
+	for _, o := range chunks {
+		if o.IsDir {
+			continue
+		}
+		stats.Chunks++
+		if marked[strings.TrimPrefix(o.Key, chunkPrefix)] {
+			stats.Referenced++
+			continue
+		}
+		if start.Sub(o.Mtime) < opt.Grace {
+			stats.Young++
+			continue
+		}
+		if !opt.DryRun {
+			cur, err := store.Head(o.Key)
+			if err != nil {
+				klog.Errorf("Head chunk %v error %v", o.Key, err)
+				continue
+			}
+			if time.Since(cur.Mtime) < opt.Grace {
+				stats.Young++
+				continue
+			}
+		}
+		report(o)
+		if !opt.DryRun {
+			if err := store.Delete(o.Key); err != nil {
+				return stats, err
+			}
+		}
+		stats.Deleted++
+		stats.Freed += o.Size
+	}
+	return stats, nil
+}
@@ -0,0 +1,145 @@
+package fuse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+// agedStore makes every object look stored two hours ago, except to Head
+// for the keys in fresh.
+type agedStore struct {
+	backend.ObjectStorage
+	fresh map[string]bool
+}
+
+func (s *agedStore) List(prefix string) ([]backend.Object, error) {
+	objs, err := s.ObjectStorage.List(prefix)
+	for i := range objs {
+		objs[i].Mtime = objs[i].Mtime.Add(-2 * time.Hour)
+	}
+	return objs, err
+}
+
+func (s *agedStore) Head(key string) (backend.Object, error) {
+	o, err := s.ObjectStorage.Head(key)
+	if !s.fresh[key] {
+		o.Mtime = o.Mtime.Add(-2 * time.Hour)
+	}
+	return o, err
+}
+
+// putChunkTest stores data as a chunk that no layout references.
+func putChunkTest(t *testing.T, store backend.ObjectStorage, data string) string {
+	t.Helper()
+	key := chunkPrefix + ID(sha256.Sum256([]byte(data))).String()
+	if err := store.Put(key, nil, bytes.NewReader([]byte(data))); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func exists(store backend.ObjectStorage, key string) bool {
+	_, err := store.Head(key)
+	return err == nil
+}
+
+func TestCollectGarbage(t *testing.T) {
+	inner := mem.NewMemClient("t")
+	fs := mountTest(t, inner, t.TempDir(), true, true, "")
+	f := writeFile(t, rootDir(fs), "f", testData(2*ChunkCacheFixedSize, 28))
+	garbage := putChunkTest(t, inner, "garbage")
+	kept := putChunkTest(t, inner, "kept")
+	// touched is found stored by a writer after gc listed it
+	touched := putChunkTest(t, inner, "touched")
+	store := &agedStore{ObjectStorage: inner, fresh: map[string]bool{touched: true}}
+	refs := len(layoutTest(t, f))
+
+	var reported []string
+	collect := func(opt GCOption) *GCStats {
+		reported = nil
+		opt.Keep = map[string]uint64{kept[len(chunkPrefix):]: 1}
+		stats, err := CollectGarbage(store, opt, func(o backend.Object) {
+			reported = append(reported, o.Key)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	stats := collect(GCOption{Grace: 3 * time.Hour})
+	if stats.Young != 2 || stats.Deleted != 0 {
+		t.Fatalf("chunks in the grace period were deleted: %+v", stats)
+	}
+	stats = collect(GCOption{Grace: time.Hour, DryRun: true})
+	if stats.Deleted != 2 || len(reported) != 2 || !exists(inner, garbage) {
+		t.Fatalf("dry run found %+v, reported %q", stats, reported)
+	}
+	stats = collect(GCOption{Grace: time.Hour})
+	if stats.Layouts != 1 || stats.Referenced != refs+1 || stats.Deleted != 1 || stats.Young != 1 {
+		t.Fatalf("gc found %+v, want %d referenced chunks", stats, refs+1)
+	}
+	if exists(inner, garbage) || !exists(inner, touched) || !exists(inner, kept) {
+		t.Fatalf("gc deleted the wrong chunks, reported %q", reported)
+	}
+	for _, m := range layoutTest(t, f) {
+		if !exists(inner, chunkPrefix+m.Hash) {
+			t.Fatalf("gc deleted a referenced chunk")
+		}
+	}
+}
+
+func TestDropSharedChunks(t *testing.T) {
+	inner := mem.NewMemClient("t")
+	fs := mountTest(t, inner, t.TempDir(), true, true, "")
+	data := testData(2*ChunkCacheFixedSize, 29)
+	a := writeFile(t, rootDir(fs), "a", data)
+	chunks := layoutTest(t, a)
+	first, second := chunkPrefix+chunks[0].Hash, chunkPrefix+chunks[1].Hash
+
+	// another mount of the bucket may use the chunks, they are left to gc
+	truncateTest(t, a, 0)
+	if !exists(inner, first) || !exists(inner, second) {
+		t.Fatalf("truncate deleted a shared chunk")
+	}
+	store := &agedStore{ObjectStorage: inner}
+	stats, err := CollectGarbage(store, GCOption{Grace: time.Hour}, func(backend.Object) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Deleted != 2 || exists(inner, first) || exists(inner, second) {
+		t.Fatalf("gc of the dropped chunks found %+v", stats)
+	}
+}
+
+func TestTouchChunks(t *testing.T) {
+	store := mem.NewMemClient("t")
+	fs := mountTest(t, store, t.TempDir(), true, true, "")
+	data := testData(ChunkCacheFixedSize, 30)
+	f := writeFile(t, rootDir(fs), "f", data)
+	key := chunkPrefix + layoutTest(t, f)[0].Hash
+
+	// a chunk gc deletes after the writer found it is stored again
+	w := NewChunkWriter(f.id+1, "g", fs, "", true).(*ChunkWriter)
+	defer w.Release()
+	fs.Backend = &collectedStore{store}
+	if _, _, err := w.putChunk(data); err != nil || !exists(store, key) {
+		t.Fatalf("putChunk of a chunk deleted meanwhile = %v", err)
+	}
+}
+
+// collectedStore deletes an object right before it is copied, as gc does
+// between a writer finding a chunk and touching it.
+type collectedStore struct {
+	backend.ObjectStorage
+}
+
+func (s *collectedStore) Copy(src, dst string) error {
+	s.ObjectStorage.Delete(src)
+	return s.ObjectStorage.Copy(src, dst)
+}
@@ -1,12 +1,68 @@
 package fuse
 
-var ino uint64
+import (
+	"time"
 
-func init() {
-	ino = 2
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/meta"
+)
+
+// Inode is the state of a file shared by all of its hard links.
+type Inode struct {
+	id     uint64
+	typ    fuse.DirentType
+	attr   *fuse.Attr
+	fs     *FileSystem
+	target string
+	// key is the object holding the data once the file has been linked
+	// more than once, it is always the path of one of its links.
+	key   string
+	links []*File
+}
+
+func newFile(parent *Dir, name string, node *Inode) *File {
+	f := &File{
+		Inode:  node,
+		parent: parent,
+		name:   name,
+	}
+	node.links = append(node.links, f)
+	return f
+}
+
+func (fs *FileSystem) GenerateInode() (uint64, error) {
+	return fs.meta.NextInode()
+}
+
+func toInode(id uint64, typ fuse.DirentType, attr *fuse.Attr) *meta.Inode {
+	i := &meta.Inode{Ino: id, Type: uint32(typ)}
+	setInode(i, attr)
+	return i
+}
+
+func setInode(i *meta.Inode, attr *fuse.Attr) {
+	i.Mode = attr.Mode
+	i.Uid = attr.Uid
+	i.Gid = attr.Gid
+	i.Size = attr.Size
+	i.Nlink = attr.Nlink
+	i.Atime = attr.Atime
+	i.Mtime = attr.Mtime
+	i.Ctime = attr.Ctime
 }
 
-func GenerateInode() uint64 {
-	ino++
-	return ino
+func toAttr(i *meta.Inode) *fuse.Attr {
+	return &fuse.Attr{
+		Valid:     time.Second,
+		Inode:     i.Ino,
+		Size:      i.Size,
+		Atime:     i.Atime,
+		Mtime:     i.Mtime,
+		Ctime:     i.Ctime,
+		Mode:      i.Mode,
+		Nlink:     i.Nlink,
+		Uid:       i.Uid,
+		Gid:       i.Gid,
+		BlockSize: 512,
+	}
 }
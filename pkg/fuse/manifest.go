@@ -0,0 +1,450 @@
+package fuse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+	"github.com/nevermore/muyifs/pkg/compress/lz4"
+	"github.com/nevermore/muyifs/pkg/compress/snappy"
+	"github.com/nevermore/muyifs/pkg/compress/zstd"
+	"github.com/restic/chunker"
+)
+
+const (
+	// manifestVersion is the version of the manifests written, versions
+	// 0 and 1 are JSON, later ones binary.
+	manifestVersion = 2
+	// manifestKey is the object metadata holding the manifest version.
+	manifestKey = "manifest"
+	// manifestMagic starts a binary manifest.
+	manifestMagic = "MYFM"
+	// manifestPageChunks is the number of chunks in a page of a binary
+	// manifest. <key>/.meta holds the first page, the others are stored
+	// as <key>/.meta.<sha256 of the page>.
+	manifestPageChunks = 1 << 14
+
+	// Flags of a binary manifest and of its chunks.
+	manifestFixed = 1 << 0
+	chunkHole     = 1 << 0
+	chunkHashed   = 1 << 1
+
+	// Parameters of content defined chunking.
+	chunkerPol     = chunker.Pol(0x3DA3358B4DC173)
+	chunkerMinSize = 1 << 22
+	chunkerMaxSize = ChunkCacheDynamicReadSize
+	chunkerAvgBits = 23
+)
+
+// Manifest describes how the data of a chunked file is stored, it is kept
+// in <key>/.meta and in the inode. It records everything needed to read the
+// chunks back, so files written under different mount settings can be read
+// by any mount.
+type Manifest struct {
+	Version int `json:"version"`
+	// Codec is the compression of the chunks, "" when they are not
+	// compressed.
+	Codec string `json:"codec,omitempty"`
+	// Fixed tells whether the file is cut into chunks of ChunkSize bytes,
+	// else it is cut by content with the chunker parameters.
+	Fixed     bool        `json:"fixed"`
+	ChunkSize int64       `json:"chunk_size,omitempty"`
+	Pol       chunker.Pol `json:"pol,omitempty"`
+	MinSize   uint        `json:"min_size,omitempty"`
+	MaxSize   uint        `json:"max_size,omitempty"`
+	AvgBits   int         `json:"avg_bits,omitempty"`
+	// Size is the size of the file.
+	Size   int64       `json:"size"`
+	Chunks []ChunkMeta `json:"chunks"`
+	// Pages holds the hashes of the pages of a binary manifest after the
+	// first one.
+	Pages []string `json:"-"`
+}
+
+// maxChunk returns the size of the largest chunk the file may have.
+func (m *Manifest) maxChunk() int64 {
+	if m.Fixed {
+		return m.ChunkSize
+	}
+	return int64(m.MaxSize)
+}
+
+// decodeManifest decodes a manifest kept in the inode, which holds all of
+// its pages.
+func decodeManifest(b []byte) (*Manifest, error) {
+	return readManifest(bytes.NewReader(b), nil)
+}
+
+// getManifest reads the manifest of the chunked file key and its pages
+// from store.
+func getManifest(store backend.ObjectStorage, key string) (*Manifest, error) {
+	return readManifest(newObjectReader(store, key+metaSuffix), func(hash string) io.Reader {
+		return newObjectReader(store, pageKey(key, hash))
+	})
+}
+
+// pageKey is the object holding the page hash of the manifest of key.
+func pageKey(key, hash string) string {
+	return key + metaSuffix + "." + hash
+}
+
+// readManifest decodes a manifest as it is read from r. A binary manifest
+// continues in the pages page opens when r ends early, page is nil when r
+// holds all of them. A JSON manifest is read whole.
+func readManifest(r io.Reader, page func(hash string) io.Reader) (*Manifest, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(manifestMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(head) != manifestMagic {
+		b, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		return decodeJSONManifest(b)
+	}
+	m, n, err := readManifestHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if n < manifestPageChunks {
+		m.Chunks = make([]ChunkMeta, 0, n)
+	}
+	prev := ChunkMeta{Index: -1}
+	var sum hash.Hash
+	for p := 0; len(m.Chunks) < n; {
+		c, err := readChunk(br, prev)
+		if err == io.EOF {
+			if err := checkPage(sum, m.Pages, p); err != nil {
+				return nil, err
+			}
+			if p == len(m.Pages) || page == nil {
+				return nil, fmt.Errorf("manifest ends after %d of %d chunks", len(m.Chunks), n)
+			}
+			sum = sha256.New()
+			br = bufio.NewReader(io.TeeReader(page(m.Pages[p]), sum))
+			p++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Chunks = append(m.Chunks, c)
+		prev = c
+	}
+	if sum != nil {
+		if _, err := io.Copy(ioutil.Discard, br); err != nil {
+			return nil, err
+		}
+		if err := checkPage(sum, m.Pages, len(m.Pages)); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// checkPage checks that the page read before page p has its hash.
+func checkPage(sum hash.Hash, pages []string, p int) error {
+	if sum == nil || p == 0 {
+		return nil
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != pages[p-1] {
+		return fmt.Errorf("manifest page %s has hash %s", pages[p-1], got)
+	}
+	return nil
+}
+
+// decodeJSONManifest decodes a JSON manifest. A plain chunk list written
+// before there were manifests comes back with Version 0, it is stored the
+// way the mount is set up.
+func decodeJSONManifest(b []byte) (*Manifest, error) {
+	b = bytes.TrimSpace(b)
+	m := &Manifest{}
+	if len(b) > 0 && b[0] == '[' {
+		if err := json.Unmarshal(b, &m.Chunks); err != nil {
+			return nil, err
+		}
+		for _, c := range m.Chunks {
+			if c.End > m.Size {
+				m.Size = c.End
+			}
+		}
+		return m, nil
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	if m.Version > 1 {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if err := checkCodec(m.Codec); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readManifestHeader decodes the header of a binary manifest, it returns
+// the number of chunks that follow.
+func readManifestHeader(r *bufio.Reader) (*Manifest, int, error) {
+	b := make([]byte, len(manifestMagic)+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, unexpected(err)
+	}
+	if string(b[:len(manifestMagic)]) != manifestMagic {
+		return nil, 0, errors.New("not a binary manifest")
+	}
+	m := &Manifest{Version: int(b[len(manifestMagic)])}
+	if m.Version > manifestVersion {
+		return nil, 0, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	m.Fixed = b[len(manifestMagic)+1]&manifestFixed != 0
+	var v [9]uint64
+	for i := range v {
+		var err error
+		if v[i], err = binary.ReadUvarint(r); err != nil {
+			return nil, 0, unexpected(err)
+		}
+	}
+	if v[0] > 64 {
+		return nil, 0, fmt.Errorf("manifest codec of %d bytes", v[0])
+	}
+	codec := make([]byte, v[0])
+	if _, err := io.ReadFull(r, codec); err != nil {
+		return nil, 0, unexpected(err)
+	}
+	m.Codec = string(codec)
+	if err := checkCodec(m.Codec); err != nil {
+		return nil, 0, err
+	}
+	m.ChunkSize, m.Pol = int64(v[1]), chunker.Pol(v[2])
+	m.MinSize, m.MaxSize, m.AvgBits = uint(v[3]), uint(v[4]), int(v[5])
+	m.Size = int64(v[6])
+	if v[8] > v[7] || v[7] > (v[8]+1)*manifestPageChunks {
+		return nil, 0, fmt.Errorf("manifest of %d chunks in %d pages", v[7], v[8]+1)
+	}
+	for i := uint64(0); i < v[8]; i++ {
+		h := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return nil, 0, unexpected(err)
+		}
+		m.Pages = append(m.Pages, hex.EncodeToString(h))
+	}
+	return m, int(v[7]), nil
+}
+
+// readChunk decodes the chunk that follows prev, it returns io.EOF when r
+// ends before it.
+func readChunk(r *bufio.Reader, prev ChunkMeta) (ChunkMeta, error) {
+	var c ChunkMeta
+	flags, err := r.ReadByte()
+	if err != nil {
+		return c, err
+	}
+	index, err := binary.ReadVarint(r)
+	if err != nil {
+		return c, unexpected(err)
+	}
+	gap, err := binary.ReadVarint(r)
+	if err != nil {
+		return c, unexpected(err)
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return c, unexpected(err)
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return c, unexpected(err)
+	}
+	c.Index = prev.Index + 1 + int(index)
+	c.Start = prev.End + gap
+	c.End = c.Start + int64(length)
+	c.CompressSize = int64(size)
+	c.Hole = flags&chunkHole != 0
+	if flags&chunkHashed != 0 {
+		h := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return c, unexpected(err)
+		}
+		c.Hash = hex.EncodeToString(h)
+	}
+	return c, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// encodeManifest encodes m in the binary format, split into pages of
+// manifestPageChunks chunks. The first page starts with the header, which
+// holds the hashes of the others, and m.Pages is set to them. Empty chunks
+// are left out.
+func encodeManifest(m *Manifest) ([][]byte, error) {
+	var pages [][]byte
+	var page []byte
+	n := 0
+	prev := ChunkMeta{Index: -1}
+	for _, c := range m.Chunks {
+		if c.Start >= c.End {
+			continue
+		}
+		if n > 0 && n%manifestPageChunks == 0 {
+			pages = append(pages, page)
+			page = nil
+		}
+		var flags byte
+		if c.Hole {
+			flags |= chunkHole
+		}
+		var h []byte
+		if c.Hash != "" {
+			var err error
+			if h, err = hex.DecodeString(c.Hash); err != nil || len(h) != sha256.Size {
+				return nil, fmt.Errorf("chunk %d has a bad hash %q", c.Index, c.Hash)
+			}
+			flags |= chunkHashed
+		}
+		page = append(page, flags)
+		page = appendVarint(page, int64(c.Index-prev.Index-1))
+		page = appendVarint(page, c.Start-prev.End)
+		page = appendUvarint(page, uint64(c.End-c.Start))
+		page = appendUvarint(page, uint64(c.CompressSize))
+		page = append(page, h...)
+		prev = c
+		n++
+	}
+	pages = append(pages, page)
+
+	m.Pages = nil
+	for _, p := range pages[1:] {
+		sum := sha256.Sum256(p)
+		m.Pages = append(m.Pages, hex.EncodeToString(sum[:]))
+	}
+	head := append([]byte(manifestMagic), manifestVersion, 0)
+	if m.Fixed {
+		head[len(manifestMagic)+1] |= manifestFixed
+	}
+	for _, v := range []uint64{
+		uint64(len(m.Codec)), uint64(m.ChunkSize), uint64(m.Pol),
+		uint64(m.MinSize), uint64(m.MaxSize), uint64(m.AvgBits),
+		uint64(m.Size), uint64(n), uint64(len(m.Pages)),
+	} {
+		head = appendUvarint(head, v)
+	}
+	head = append(head, m.Codec...)
+	for _, p := range pages[1:] {
+		sum := sha256.Sum256(p)
+		head = append(head, sum[:]...)
+	}
+	pages[0] = append(head, pages[0]...)
+	return pages, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// layout encodes m as it is kept in the inode, a binary manifest with all
+// of its pages.
+func (m *Manifest) layout() ([]byte, error) {
+	switch m.Version {
+	case 0:
+		return json.Marshal(m.Chunks)
+	case 1:
+		return json.Marshal(m)
+	}
+	pages, err := encodeManifest(m)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(pages, nil), nil
+}
+
+// objectReader reads an object, which is fetched whole with one Get at the
+// first Read.
+type objectReader struct {
+	store backend.ObjectStorage
+	key   string
+	data  *bytes.Reader
+}
+
+func newObjectReader(store backend.ObjectStorage, key string) *objectReader {
+	return &objectReader{store: store, key: key}
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.data == nil {
+		o, err := r.store.Head(r.key)
+		if err != nil {
+			return 0, err
+		}
+		buf := make([]byte, o.Size)
+		if o.Size > 0 {
+			n, err := r.store.Get(r.key, 0, -1, buf)
+			if err != nil {
+				return 0, err
+			}
+			if n < len(buf) {
+				return 0, io.ErrUnexpectedEOF
+			}
+		}
+		r.data = bytes.NewReader(buf)
+	}
+	return r.data.Read(p)
+}
+
+// manifestMeta is the object metadata of <key>/.meta.
+func manifestMeta() map[string]string {
+	return map[string]string{manifestKey: strconv.Itoa(manifestVersion)}
+}
+
+// codecName returns the codec a -compress setting stands for.
+func codecName(compress string) string {
+	switch compress {
+	case "", "lz4", "snappy":
+		return compress
+	}
+	return "zstd"
+}
+
+// checkCodec fails for a codec the chunks can not be decompressed with.
+func checkCodec(codec string) error {
+	switch codec {
+	case "", "lz4", "snappy", "zstd":
+		return nil
+	}
+	return fmt.Errorf("unsupported manifest codec %q", codec)
+}
+
+// newCompress returns the compression of codec, which checkCodec accepts.
+func newCompress(codec string) Compress {
+	switch codec {
+	case "":
+		return Compress{}
+	case "lz4":
+		return Compress{Enable: true, Compress: &lz4.LZ4{}}
+	case "snappy":
+		return Compress{Enable: true, Compress: &snappy.Snappy{}}
+	}
+	return Compress{Enable: true, Compress: &zstd.ZStandard{}}
+}
@@ -0,0 +1,158 @@
+package fuse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+// countingStore counts the Get calls to the store.
+type countingStore struct {
+	backend.ObjectStorage
+	sync.Mutex
+	gets int
+}
+
+func (s *countingStore) Get(key string, off, limit int64, buf []byte) (int, error) {
+	s.Lock()
+	s.gets++
+	s.Unlock()
+	return s.ObjectStorage.Get(key, off, limit, buf)
+}
+
+// testManifest returns a manifest of n chunks with holes, gaps and chunks
+// stored before they had a hash.
+func testManifest(n int) *Manifest {
+	m := &Manifest{Version: manifestVersion, Codec: "zstd", ChunkSize: ChunkCacheFixedSize, Fixed: true}
+	var end int64
+	for i := 0; i < n; i++ {
+		c := ChunkMeta{Index: i, Start: end, End: end + int64(1000+i%7), CompressSize: int64(500 + i%3)}
+		switch i % 5 {
+		case 1:
+			c.Hole, c.CompressSize = true, 0
+		case 2:
+			// a chunk stored before chunks had a hash
+		case 3:
+			c.Start += 10
+			c.End += 10
+			fallthrough
+		default:
+			c.Hash = ID(sha256.Sum256([]byte{byte(i), byte(i >> 8)})).String()
+		}
+		m.Chunks = append(m.Chunks, c)
+		end = c.End
+	}
+	m.Size = end
+	return m
+}
+
+// putManifestTest stores m as the manifest of key the way a writer does.
+func putManifestTest(t *testing.T, store backend.ObjectStorage, key string, m *Manifest) [][]byte {
+	t.Helper()
+	pages, err := encodeManifest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, hash := range m.Pages {
+		store.Put(pageKey(key, hash), nil, bytes.NewReader(pages[i+1]))
+	}
+	store.Put(key+metaSuffix, manifestMeta(), bytes.NewReader(pages[0]))
+	return pages
+}
+
+func TestManifestPages(t *testing.T) {
+	inner := mem.NewMemClient("t")
+	store := &countingStore{ObjectStorage: inner}
+	m := testManifest(2*manifestPageChunks + 10)
+	pages := putManifestTest(t, store, "f", m)
+	if len(pages) != 3 || len(m.Pages) != 2 {
+		t.Fatalf("%d chunks encoded in %d pages", len(m.Chunks), len(pages))
+	}
+
+	// every page is fetched with one Get
+	store.gets = 0
+	got, err := getManifest(store, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.gets != len(pages) {
+		t.Fatalf("manifest of %d pages read with %d Gets", len(pages), store.gets)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Fatalf("manifest read back differs")
+	}
+	// the inode holds all of the pages
+	if got, err := decodeManifest(bytes.Join(pages, nil)); err != nil || !reflect.DeepEqual(got, m) {
+		t.Fatalf("manifest decoded from the inode differs: %v", err)
+	}
+
+	// a page that does not match its hash or is missing fails the read
+	inner.Put(pageKey("f", m.Pages[1]), nil, bytes.NewReader(pages[1]))
+	if _, err := getManifest(store, "f"); err == nil {
+		t.Fatalf("manifest with a swapped page was read")
+	}
+	inner.Delete(pageKey("f", m.Pages[1]))
+	if _, err := getManifest(store, "f"); err == nil {
+		t.Fatalf("manifest with a missing page was read")
+	}
+	if _, err := decodeManifest(pages[0]); err == nil {
+		t.Fatalf("first page alone decoded as the whole manifest")
+	}
+}
+
+func TestManifestFormats(t *testing.T) {
+	store := mem.NewMemClient("t")
+	m := testManifest(3)
+	putManifestTest(t, store, "small", m)
+	if got, err := getManifest(store, "small"); err != nil || !reflect.DeepEqual(got, m) || len(got.Pages) != 0 {
+		t.Fatalf("single page manifest read back %+v, %v", got, err)
+	}
+
+	// a chunk list written before there were manifests
+	legacy := `[{"index":0,"start":0,"end":10,"compress_size":10},{"index":1,"start":10,"end":25,"compress_size":15}]`
+	store.Put("legacy"+metaSuffix, nil, strings.NewReader(legacy))
+	got, err := getManifest(store, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 0 || got.Size != 25 || len(got.Chunks) != 2 {
+		t.Fatalf("legacy chunk list read as %+v", got)
+	}
+	store.Put("json"+metaSuffix, nil, strings.NewReader(`{"version":1,"codec":"lz4","fixed":true,"chunk_size":10,"size":0,"chunks":[]}`))
+	if got, err := getManifest(store, "json"); err != nil || got.Version != 1 || got.Codec != "lz4" {
+		t.Fatalf("JSON manifest read as %+v, %v", got, err)
+	}
+
+	// manifests of later versions are refused
+	pages, _ := encodeManifest(testManifest(1))
+	future := append([]byte(nil), pages[0]...)
+	future[len(manifestMagic)] = manifestVersion + 1
+	if _, err := decodeManifest(future); err == nil {
+		t.Fatalf("manifest of a later version was decoded")
+	}
+	store.Put("future"+metaSuffix, nil, strings.NewReader(`{"version":2}`))
+	if _, err := getManifest(store, "future"); err == nil {
+		t.Fatalf("JSON manifest of a binary version was decoded")
+	}
+	if _, err := decodeManifest(pages[0][:len(pages[0])-1]); err == nil {
+		t.Fatalf("cut manifest was decoded")
+	}
+
+	// chunks of an unknown codec can not be read
+	unknown := testManifest(1)
+	unknown.Codec = "brotli"
+	putManifestTest(t, store, "unknown", unknown)
+	if _, err := getManifest(store, "unknown"); err == nil {
+		t.Fatalf("manifest of an unknown codec was decoded")
+	}
+	store.Put("unknown"+metaSuffix, nil, strings.NewReader(`{"version":1,"codec":"brotli","size":0,"chunks":[]}`))
+	if _, err := getManifest(store, "unknown"); err == nil {
+		t.Fatalf("JSON manifest of an unknown codec was decoded")
+	}
+}
@@ -2,26 +2,33 @@ package fuse
 
 import (
 	"fmt"
+	"io"
+	"strconv"
 
 	"github.com/nevermore/muyifs/pkg/backend"
 	"k8s.io/klog/v2"
 )
 
 type WriterAt struct {
-	key   string
-	fs    *FileSystem
+	key string
+	fs  *FileSystem
+	// base is the size of the existing data that the upload keeps.
+	base  int64
 	cache *WriteCache
 }
 
 type WriteCache struct {
 	uploadID string
+	// part holds the parts copied from the existing data.
 	part     []*backend.Part
 	num      int
+	maxCount int
 	length   uint64
 	offset   int64
 	errState bool
 	buf      []byte
 	chunks   []*Chunk
+	uploader *partUploader
 }
 
 type Chunk struct {
@@ -38,7 +45,6 @@ func NewWriter(key string, fs *FileSystem) CommonWriter {
 			part:     nil,
 			num:      1,
 			length:   0,
-			buf:      make([]byte, CacheSize, CacheSize),
 		},
 	}
 }
@@ -52,36 +58,22 @@ func (w *WriterAt) WriteAt(p []byte, off int64) (n int, err error) {
 
 	pLen := len(p)
 	// Init
-	if off == 0 {
-		mu, err := w.fs.Backend.InitiateMultipartUpload(w.key)
-		if err != nil {
+	if w.cache.uploadID == "" {
+		if err := w.initUpload(); err != nil {
 			klog.Errorf("WriteAt buffer InitiateMultipartUpload error %v", err)
-			return 0, err
-		}
-		w.cache.uploadID = mu.UploadID
-		w.cache.length = 0
-		w.cache.offset = 0
-		w.cache.num = 1
-		w.cache.part = make([]*backend.Part, 0)
-	}
-
-	if w.cache.length+uint64(pLen) > CacheSize {
-		// need upload
-		part, err := w.fs.Backend.UploadPart(w.key, w.cache.uploadID, w.cache.num, w.cache.buf[:w.cache.length])
-		if err != nil {
-			klog.Errorf("WriteAt buffer error %v", err)
 			w.cache.errState = true
 			return 0, err
 		}
-		w.cache.part = append(w.cache.part, part)
-		w.cache.length = 0
-		w.cache.num++
+	}
+	if err := w.cache.uploader.error(); err != nil {
+		w.cache.errState = true
+		return 0, err
 	}
 
 	if off == w.cache.offset {
-		copy(w.cache.buf[w.cache.length:w.cache.length+uint64(pLen)], p)
-		w.cache.length += uint64(pLen)
-		w.cache.offset += int64(pLen)
+		if err := w.push(p); err != nil {
+			return 0, err
+		}
 	} else {
 		c := &Chunk{}
 		c.offset = off
@@ -89,95 +81,174 @@ func (w *WriterAt) WriteAt(p []byte, off int64) (n int, err error) {
 		copy(c.buf, p)
 		w.cache.chunks = append(w.cache.chunks, c)
 	}
+	if err := w.pushChunks(); err != nil {
+		return 0, err
+	}
+	return pLen, nil
+}
 
+// push appends p to the part buffer, full parts are handed to the uploader.
+func (w *WriterAt) push(p []byte) error {
+	for len(p) > 0 {
+		if w.cache.length == uint64(len(w.cache.buf)) {
+			if w.cache.num >= w.cache.maxCount {
+				w.cache.errState = true
+				return fmt.Errorf("%v is over the size limit of %d parts", w.key, w.cache.maxCount)
+			}
+			w.cache.uploader.upload(w.cache.num, w.cache.buf)
+			w.cache.num++
+			w.cache.buf = w.cache.uploader.buffer(partSize(w.cache.num, w.cache.maxCount))
+			w.cache.length = 0
+			if err := w.cache.uploader.error(); err != nil {
+				w.cache.errState = true
+				return err
+			}
+		}
+		n := copy(w.cache.buf[w.cache.length:], p)
+		w.cache.length += uint64(n)
+		w.cache.offset += int64(n)
+		p = p[n:]
+	}
+	return nil
+}
+
+// pushChunks pushes the out of order writes that have become contiguous.
+func (w *WriterAt) pushChunks() error {
 	for i := 0; i < len(w.cache.chunks); {
 		if w.cache.chunks[i].offset == w.cache.offset {
-			if w.cache.length+uint64(len(w.cache.chunks[i].buf)) > CacheSize {
-				part, err := w.fs.Backend.UploadPart(w.key, w.cache.uploadID, w.cache.num, w.cache.buf[:w.cache.length])
-				if err != nil {
-					klog.Errorf("WriteAt buffer error %v", err)
-					w.cache.errState = true
-					return 0, err
-				}
-				w.cache.part = append(w.cache.part, part)
-				w.cache.length = 0
-				w.cache.num++
+			if err := w.push(w.cache.chunks[i].buf); err != nil {
+				return err
 			}
-			copy(w.cache.buf[w.cache.length:w.cache.length+uint64(len(w.cache.chunks[i].buf))], w.cache.chunks[i].buf)
-			w.cache.length += uint64(len(w.cache.chunks[i].buf))
-			w.cache.offset += int64(len(w.cache.chunks[i].buf))
 			w.cache.chunks = append(w.cache.chunks[:i], w.cache.chunks[i+1:]...)
 			i = 0
 			continue
 		}
 		i++
 	}
+	return nil
+}
+
+// appendTo makes the writer keep the size bytes stored for its key, the
+// next write is expected at size.
+func (w *WriterAt) appendTo(size int64) {
+	w.base = size
+}
+
+func (w *WriterAt) initUpload() error {
+	mu, err := w.fs.Backend.InitiateMultipartUpload(w.key)
+	if err != nil {
+		return err
+	}
+	w.cache.uploadID = mu.UploadID
+	w.cache.length = 0
+	w.cache.offset = 0
+	w.cache.num = 1
+	w.cache.maxCount = mu.MaxCount
+	w.cache.part = make([]*backend.Part, 0)
+	w.cache.uploader = newPartUploader(w.fs, w.key, mu.UploadID)
+	w.cache.buf = w.cache.uploader.buffer(partSize(1, mu.MaxCount))
+	if w.base == 0 {
+		return nil
+	}
 
-	return pLen, nil
+	// The existing data is copied into the upload on the server side, a
+	// head too small to be a part is loaded into the buffer instead.
+	if w.base < int64(mu.MinPartSize) {
+		if err := w.fs.readFull(w.key, 0, w.cache.buf[:w.base]); err != nil {
+			return err
+		}
+		w.cache.length = uint64(w.base)
+		w.cache.offset = w.base
+		return nil
+	}
+	w.cache.part, w.cache.num, err = w.fs.copyParts(w.key, mu, w.base)
+	if err != nil {
+		return err
+	}
+	w.cache.offset = w.base
+	return nil
+}
+
+// copyParts copies the first keep bytes of the object key into the upload
+// mu on the server side, keep is at least mu.MinPartSize. It returns the
+// copied parts and the number of the next part. The upload is aborted when
+// a copy fails.
+func (fs *FileSystem) copyParts(key string, mu *backend.MultipartUpload, keep int64) ([]*backend.Part, int, error) {
+	var parts []*backend.Part
+	num := 1
+	for off := int64(0); off < keep; num++ {
+		n := keep - off
+		if n-backend.CopyPartSize >= int64(mu.MinPartSize) {
+			n = backend.CopyPartSize
+		}
+		p, err := fs.Backend.UploadPartCopy(key, mu.UploadID, num, key, off, n)
+		if err != nil {
+			fs.Backend.AbortUpload(key, mu.UploadID)
+			return nil, 0, err
+		}
+		parts = append(parts, p)
+		off += n
+	}
+	return parts, num, nil
 }
 
 func (w *WriterAt) Flush() error {
 	if w.cache.errState {
 		klog.Errorf("WriteAt has cache error, do not flush")
-		w.fs.Backend.AbortUpload(w.key, w.cache.uploadID)
+		w.abort()
 		return fmt.Errorf("flush error")
 	}
-
-	if w.cache.length == 0 && len(w.cache.chunks) == 0 {
+	if w.cache.uploadID == "" {
 		return nil
 	}
 
-	// do upload
-	for i := 0; i < len(w.cache.chunks); {
-		if w.cache.chunks[i].offset == w.cache.offset {
-			if w.cache.length+uint64(len(w.cache.chunks[i].buf)) > CacheSize {
-				part, err := w.fs.Backend.UploadPart(w.key, w.cache.uploadID, w.cache.num, w.cache.buf[:w.cache.length])
-				if err != nil {
-					klog.Errorf("WriteAt buffer error %v", err)
-					w.cache.errState = true
-					return err
-				}
-				w.cache.part = append(w.cache.part, part)
-				w.cache.length = 0
-				w.cache.num++
-			}
-			copy(w.cache.buf[w.cache.length:w.cache.length+uint64(len(w.cache.chunks[i].buf))], w.cache.chunks[i].buf)
-			w.cache.length += uint64(len(w.cache.chunks[i].buf))
-			w.cache.offset += int64(len(w.cache.chunks[i].buf))
-			w.cache.chunks = append(w.cache.chunks[:i], w.cache.chunks[i+1:]...)
-			i = 0
-			continue
-		}
-		i++
+	if err := w.pushChunks(); err != nil {
+		w.abort()
+		return err
 	}
-
 	if w.cache.length > 0 {
-		part, err := w.fs.Backend.UploadPart(w.key, w.cache.uploadID, w.cache.num, w.cache.buf[:w.cache.length])
-		if err != nil {
-			klog.Errorf("WriteAt buffer error %v", err)
-			w.cache.errState = true
-			return err
-		}
-		w.cache.part = append(w.cache.part, part)
+		w.cache.uploader.upload(w.cache.num, w.cache.buf[:w.cache.length])
+		w.cache.num++
+		w.cache.buf = nil
 		w.cache.length = 0
-		w.cache.num = 1
+	}
+	parts, err := w.cache.uploader.wait()
+	if err != nil {
+		klog.Errorf("WriteAt buffer error %v", err)
+		w.cache.errState = true
+		w.abort()
+		return err
 	}
 
-	err := w.fs.Backend.CompleteUpload(w.key, w.cache.uploadID, w.cache.part)
+	err = w.fs.Backend.CompleteUpload(w.key, w.cache.uploadID, append(w.cache.part, parts...))
 	if err != nil {
 		klog.Errorf("WriteAt CompleteUpload error %v", err)
 		w.cache.errState = true
 		return err
 	}
-
+	w.cache.uploadID = ""
+	w.fs.invalidate(w.key)
 	return nil
 }
 
+// abort waits for the parts in flight and drops the upload.
+func (w *WriterAt) abort() {
+	if w.cache.uploadID == "" {
+		return
+	}
+	w.cache.uploader.wait()
+	w.fs.Backend.AbortUpload(w.key, w.cache.uploadID)
+	w.cache.uploadID = ""
+}
+
 func (w *WriterAt) Release() {
+	w.abort()
 	w.cache.uploadID = ""
 	w.cache.part = nil
 	w.cache.num = 1
 	w.cache.length = 0
+	w.cache.buf = nil
+	w.cache.uploader = nil
 	w.cache.chunks = make([]*Chunk, 0)
 	w.cache.errState = false
 }
@@ -185,19 +256,23 @@ func (w *WriterAt) Release() {
 type ReaderAt struct {
 	key      string
 	errState bool
+	loaded   bool
 	fs       *FileSystem
 	cache    *ReadCache
+	ra       *readahead
 }
 
 type ReadCache struct {
 	start  int64
 	offset int64
 	size   int64
-	buf    []byte
+	// version names the stored data in the disk cache.
+	version string
+	buf     []byte
 }
 
 func NewReader(key string, fs *FileSystem) CommonReader {
-	return &ReaderAt{
+	r := &ReaderAt{
 		key:      key,
 		errState: false,
 		fs:       fs,
@@ -205,9 +280,42 @@ func NewReader(key string, fs *FileSystem) CommonReader {
 			start:  0,
 			offset: 0,
 			size:   0,
-			buf:    make([]byte, CacheSize, CacheSize),
 		},
 	}
+	r.ra = newReadahead(fs.readahead, r.block)
+	return r
+}
+
+// block describes the CacheSize block index of the object to the readahead.
+func (r *ReaderAt) block(index int) (int64, func(buf []byte) error) {
+	off := int64(index) * CacheSize
+	if off >= r.cache.size {
+		return 0, nil
+	}
+	size := r.cache.size - off
+	if size > CacheSize {
+		size = CacheSize
+	}
+	version := r.cache.version
+	return size, func(buf []byte) error {
+		return r.fetch(version, off, buf)
+	}
+}
+
+// fetch reads the data at off, a multiple of CacheSize, of the version of
+// the object through the block cache.
+func (r *ReaderAt) fetch(version string, off int64, buf []byte) error {
+	k := blockKey{key: r.key, version: version}
+	return r.fs.blocks.read(k, off, buf, func(buf []byte) error {
+		if r.fs.disk.getBlocks(r.key, version, off, buf) {
+			return nil
+		}
+		if err := r.fs.readFull(r.key, off, buf); err != nil {
+			return err
+		}
+		r.fs.disk.putBlocks(r.key, version, off, buf)
+		return nil
+	})
 }
 
 func (r *ReaderAt) ReadAt(p []byte, offset int64) (n int, err error) {
@@ -216,7 +324,7 @@ func (r *ReaderAt) ReadAt(p []byte, offset int64) (n int, err error) {
 		return 0, fmt.Errorf("read is in error state")
 	}
 
-	if offset == 0 {
+	if offset == 0 || !r.loaded {
 		o, err := r.fs.Backend.Head(r.key)
 		if err != nil {
 			r.errState = true
@@ -224,13 +332,26 @@ func (r *ReaderAt) ReadAt(p []byte, offset int64) (n int, err error) {
 			return 0, err
 		}
 		r.cache.size = o.Size
+		r.cache.version = strconv.FormatInt(o.Size, 10) + "-" + strconv.FormatInt(o.Mtime.UnixNano(), 10)
+		r.loaded = true
 	}
 
 	if offset >= r.cache.size {
-		klog.Errorf("buffer has download, over")
-		return len(p), nil
+		return 0, io.EOF
 	}
+	// the object ends before p does
+	if end := r.cache.size - offset; int64(len(p)) > end {
+		n, err = r.readAt(p[:end], offset)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return r.readAt(p, offset)
+}
 
+// readAt reads p at offset, which lies within the object.
+func (r *ReaderAt) readAt(p []byte, offset int64) (n int, err error) {
 	// Reload
 	if offset+int64(len(p)) > r.cache.offset {
 		if r.cache.offset >= r.cache.size {
@@ -238,11 +359,23 @@ func (r *ReaderAt) ReadAt(p []byte, offset int64) (n int, err error) {
 			copy(p, r.cache.buf[newoff:newoff+r.cache.offset-offset])
 			return len(p), nil
 		}
-		n, err = r.fs.Backend.Get(r.key, r.cache.offset, CacheSize, r.cache.buf)
-		if err != nil {
-			r.errState = true
-			klog.Errorf("ReadAt error %v", err)
-			return 0, err
+		if r.cache.buf == nil {
+			r.cache.buf = make([]byte, CacheSize)
+		}
+		var ok bool
+		if r.cache.offset%CacheSize == 0 {
+			n, ok = r.ra.take(int(r.cache.offset/CacheSize), r.cache.buf)
+		}
+		if !ok {
+			n = int(r.cache.size - r.cache.offset)
+			if n > CacheSize {
+				n = CacheSize
+			}
+			if err = r.fetch(r.cache.version, r.cache.offset, r.cache.buf[:n]); err != nil {
+				r.errState = true
+				klog.Errorf("ReadAt error %v", err)
+				return 0, err
+			}
 		}
 		r.cache.start = r.cache.offset
 		r.cache.offset += int64(n)
@@ -262,6 +395,11 @@ func (r *ReaderAt) ReadAt(p []byte, offset int64) (n int, err error) {
 		klog.Errorf("ReadAt error %v", err)
 		return 0, err
 	}
+	if want := r.cache.size - offset; n < len(p) && int64(n) < want {
+		r.errState = true
+		klog.Errorf("ReadAt %v short read %d < %d", r.key, n, want)
+		return 0, io.ErrUnexpectedEOF
+	}
 	return len(p), nil
 }
 
@@ -270,4 +408,6 @@ func (r *ReaderAt) Release() {
 	r.cache.offset = 0
 	r.cache.size = 0
 	r.errState = false
+	r.loaded = false
+	r.ra.reset()
 }
@@ -0,0 +1,51 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+func TestAppend(t *testing.T) {
+	for _, c := range append([]chunking{{}}, chunkings...) {
+		chunk := c != chunking{}
+		t.Run(fmt.Sprintf("chunk=%v,%v", chunk, c), func(t *testing.T) {
+			store := mem.NewMemClient("t")
+			fs := mountTest(t, store, t.TempDir(), chunk, c.fixed, c.compress)
+			data := testData(ChunkCacheFixedSize+(1<<20), 15)
+			f := writeFile(t, rootDir(fs), "f", data)
+			var before []ChunkMeta
+			if chunk {
+				before = layoutTest(t, f)
+			} else {
+				// The stored data is copied on the server side, reading
+				// it fails.
+				store.SetFaults(mem.Faults{TruncateGet: 1})
+			}
+			for i := 0; i < 2; i++ {
+				h := openTest(t, f, fuse.OpenWriteOnly|fuse.OpenAppend)
+				tail := testData(3000, int64(16+i))
+				writeTest(t, h, tail, 0)
+				data = append(data, tail...)
+				flushTest(t, h)
+				releaseTest(t, h)
+			}
+			store.SetFaults(mem.Faults{})
+			if f.attr.Size != uint64(len(data)) || !bytes.Equal(readFile(t, f), data) {
+				t.Fatalf("appended file has size %d or wrong data", f.attr.Size)
+			}
+			if !chunk {
+				return
+			}
+			// chunks before the last one stay as they are
+			after := layoutTest(t, f)
+			if n := len(before) - 1; !reflect.DeepEqual(after[:n], before[:n]) {
+				t.Fatalf("append changed the stored chunks from %+v to %+v", before, after)
+			}
+		})
+	}
+}
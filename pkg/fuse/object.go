@@ -0,0 +1,98 @@
+package fuse
+
+import (
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// moveObjects moves everything stored for oldKey to newKey. For a file this
+// is the object itself plus its <key>/N chunks and <key>/.meta, for a
+// directory key ending with "/" it is every object below it. What was
+// stored for newKey before is replaced: the object at newKey is written
+// last and the old objects below it that the move did not overwrite are
+// deleted once it succeeded. A failed move deletes the objects it added and
+// leaves oldKey in place.
+func (fs *FileSystem) moveObjects(oldKey, newKey string) error {
+	isDir := strings.HasSuffix(oldKey, "/")
+	below := func(key string) string {
+		if isDir {
+			return key
+		}
+		return key + "/"
+	}
+	objs, err := fs.Backend.List(below(oldKey))
+	if err != nil {
+		return err
+	}
+	replaced, err := fs.Backend.List(below(newKey))
+	if err != nil {
+		return err
+	}
+	existed := make(map[string]bool)
+	for _, o := range replaced {
+		existed[o.Key] = true
+	}
+
+	var keys []string
+	for _, o := range objs {
+		if o.Key != oldKey {
+			keys = append(keys, o.Key)
+		}
+	}
+	written := make(map[string]bool)
+	undo := func() {
+		for k := range written {
+			if !existed[k] {
+				fs.invalidate(k)
+				fs.Backend.Delete(k)
+			}
+		}
+	}
+	for _, k := range keys {
+		to := newKey + strings.TrimPrefix(k, oldKey)
+		if err := fs.Backend.Copy(k, to); err != nil {
+			undo()
+			return err
+		}
+		written[to] = true
+		fs.invalidate(to)
+	}
+	if isDir {
+		err = fs.Backend.PutDirectory(newKey)
+	} else {
+		err = fs.Backend.Copy(oldKey, newKey)
+	}
+	if err != nil {
+		undo()
+		return err
+	}
+	written[newKey] = true
+	fs.invalidate(newKey)
+
+	keys = append(keys, oldKey)
+	for k := range existed {
+		if !written[k] {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		fs.invalidate(k)
+		if err := fs.Backend.Delete(k); err != nil {
+			klog.Errorf("Delete moved object %v error %v", k, err)
+		}
+	}
+	return nil
+}
+
+// deleteObjects deletes everything stored for the file key.
+func (fs *FileSystem) deleteObjects(key string) error {
+	if err := fs.Backend.DeleteList(key + "/"); err != nil {
+		return err
+	}
+	if err := fs.Backend.Delete(key); err != nil {
+		return err
+	}
+	fs.invalidate(key)
+	return nil
+}
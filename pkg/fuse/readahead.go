@@ -0,0 +1,149 @@
+package fuse
+
+import (
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ReadaheadWindow is the largest number of chunks, or CacheSize blocks
+	// of a plain object, fetched ahead of a sequential reader.
+	ReadaheadWindow = 8
+	// ReadaheadBudget is the default memory for the data read ahead of all
+	// open files.
+	ReadaheadBudget = 1 << 28
+)
+
+// budget caps the memory held by the prefetched data of all open files.
+type budget struct {
+	sync.Mutex
+	used  int64
+	limit int64
+}
+
+func newBudget(limit int64) *budget {
+	return &budget{limit: limit}
+}
+
+func (b *budget) acquire(n int64) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *budget) release(n int64) {
+	b.Lock()
+	defer b.Unlock()
+	b.used -= n
+}
+
+type prefetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// readahead spots sequential access to the blocks of a file and fetches the
+// blocks after it in the background. The window doubles with every
+// sequential block up to ReadaheadWindow and is dropped on a seek.
+type readahead struct {
+	sync.Mutex
+	budget *budget
+	// block returns the size of the block index and a function fetching
+	// it, the size is 0 past the end of the file.
+	block  func(index int) (int64, func(buf []byte) error)
+	last   int
+	window int
+	blocks map[int]*prefetch
+}
+
+func newReadahead(b *budget, block func(index int) (int64, func(buf []byte) error)) *readahead {
+	return &readahead{
+		budget: b,
+		block:  block,
+		last:   -1,
+		blocks: make(map[int]*prefetch),
+	}
+}
+
+// take copies the block index into buf when it was prefetched and moves the
+// window on. It returns false when the caller has to fetch the block itself.
+func (r *readahead) take(index int, buf []byte) (int, bool) {
+	r.Lock()
+	p := r.blocks[index]
+	delete(r.blocks, index)
+	r.advance(index)
+	r.Unlock()
+	if p == nil {
+		return 0, false
+	}
+	<-p.done
+	r.budget.release(int64(len(p.data)))
+	if p.err != nil {
+		klog.Errorf("Readahead block %d error %v", index, p.err)
+		return 0, false
+	}
+	return copy(buf, p.data), true
+}
+
+func (r *readahead) advance(index int) {
+	if index == r.last+1 {
+		r.window *= 2
+		if r.window == 0 {
+			r.window = 1
+		}
+		if r.window > ReadaheadWindow {
+			r.window = ReadaheadWindow
+		}
+	} else if index != r.last {
+		r.window = 0
+	}
+	r.last = index
+
+	for i, p := range r.blocks {
+		if i <= index || i > index+r.window {
+			delete(r.blocks, i)
+			r.drop(p)
+		}
+	}
+	for i := index + 1; i <= index+r.window; i++ {
+		if r.blocks[i] != nil {
+			continue
+		}
+		size, fetch := r.block(i)
+		if size <= 0 || !r.budget.acquire(size) {
+			break
+		}
+		p := &prefetch{done: make(chan struct{}), data: make([]byte, size)}
+		r.blocks[i] = p
+		go func() {
+			p.err = fetch(p.data)
+			close(p.done)
+		}()
+	}
+}
+
+// drop gives the memory of an unused prefetch back once it is done.
+func (r *readahead) drop(p *prefetch) {
+	go func() {
+		<-p.done
+		r.budget.release(int64(len(p.data)))
+	}()
+}
+
+// reset drops all prefetched blocks, the data they were read from changed.
+func (r *readahead) reset() {
+	r.Lock()
+	defer r.Unlock()
+	for i, p := range r.blocks {
+		delete(r.blocks, i)
+		r.drop(p)
+	}
+	r.last = -1
+	r.window = 0
+}
@@ -0,0 +1,178 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+// blockSource serves blocks of 10 bytes filled with their index and records
+// which blocks were fetched.
+type blockSource struct {
+	sync.Mutex
+	blocks  int
+	fetched []int
+}
+
+func (s *blockSource) block(index int) (int64, func(buf []byte) error) {
+	if index >= s.blocks {
+		return 0, nil
+	}
+	return 10, func(buf []byte) error {
+		s.Lock()
+		s.fetched = append(s.fetched, index)
+		s.Unlock()
+		for i := range buf {
+			buf[i] = byte(index)
+		}
+		return nil
+	}
+}
+
+// count waits for the prefetches of r and returns the number of blocks
+// fetched.
+func (s *blockSource) count(r *readahead) int {
+	for _, p := range r.blocks {
+		<-p.done
+	}
+	s.Lock()
+	defer s.Unlock()
+	return len(s.fetched)
+}
+
+// waitUsed waits for the prefetches dropped in the background to give their
+// memory back.
+func waitUsed(t *testing.T, b *budget, want int64) {
+	t.Helper()
+	for i := 0; ; i++ {
+		b.Lock()
+		used := b.used
+		b.Unlock()
+		if used == want {
+			return
+		}
+		if i == 100 {
+			t.Fatalf("budget holds %d bytes, want %d", used, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	s := &blockSource{blocks: 100}
+	b := newBudget(1000)
+	r := newReadahead(b, s.block)
+	buf := make([]byte, 10)
+
+	// the window doubles with every sequential block
+	for i, want := range []int{1, 3, 6, 11, 12} {
+		_, ok := r.take(i, buf)
+		if ok != (i > 0) {
+			t.Fatalf("block %d prefetched = %v", i, ok)
+		}
+		if ok && buf[0] != byte(i) {
+			t.Fatalf("block %d read back data of block %d", i, buf[0])
+		}
+		if n := len(r.blocks); n != min(1<<i, ReadaheadWindow) {
+			t.Fatalf("window after block %d holds %d blocks", i, n)
+		}
+		if n := s.count(r); n != want {
+			t.Fatalf("%d blocks fetched after block %d, want %d", n, i, want)
+		}
+	}
+
+	// a seek drops the window
+	if _, ok := r.take(50, buf); ok {
+		t.Fatalf("block after a seek was prefetched")
+	}
+	if len(r.blocks) != 0 {
+		t.Fatalf("seek kept %d prefetched blocks", len(r.blocks))
+	}
+	waitUsed(t, b, 0)
+
+	// nothing is read past the end
+	r.take(98, buf)
+	r.take(99, buf)
+	if len(r.blocks) != 0 {
+		t.Fatalf("%d blocks prefetched past the end", len(r.blocks))
+	}
+
+	r.take(0, buf)
+	r.take(1, buf)
+	r.reset()
+	if len(r.blocks) != 0 || r.window != 0 {
+		t.Fatalf("reset kept %d blocks and window %d", len(r.blocks), r.window)
+	}
+	waitUsed(t, b, 0)
+}
+
+func TestReadaheadBudget(t *testing.T) {
+	s := &blockSource{blocks: 100}
+	b := newBudget(15)
+	r := newReadahead(b, s.block)
+	buf := make([]byte, 10)
+	for i := 0; i < 3; i++ {
+		r.take(i, buf)
+		if len(r.blocks) > 1 {
+			t.Fatalf("%d blocks prefetched within a budget for 1", len(r.blocks))
+		}
+	}
+	if len(r.blocks) != 1 {
+		t.Fatalf("sequential reads prefetched nothing")
+	}
+	// another file shares the budget
+	other := newReadahead(b, s.block)
+	other.take(0, buf)
+	if len(other.blocks) != 0 {
+		t.Fatalf("prefetch went over the shared budget")
+	}
+	r.reset()
+	waitUsed(t, b, 0)
+	other.take(1, buf)
+	if len(other.blocks) != 1 {
+		t.Fatalf("budget given back was not reused")
+	}
+}
+
+func TestReadaheadHandle(t *testing.T) {
+	for _, c := range append([]chunking{{}}, chunkings...) {
+		chunk := c != chunking{}
+		t.Run(fmt.Sprintf("chunk=%v,%v", chunk, c), func(t *testing.T) {
+			fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), chunk, c.fixed, c.compress)
+			data := testData(CacheSize+1000, 20)
+			f := writeFile(t, rootDir(fs), "f", data)
+			h := openTest(t, f, fuse.OpenReadOnly)
+			if got := readTest(t, h, 0, 2*ChunkCacheFixedSize); !bytes.Equal(got, data[:2*ChunkCacheFixedSize]) {
+				t.Fatalf("sequential read read back wrong data")
+			}
+			fs.readahead.Lock()
+			used := fs.readahead.used
+			fs.readahead.Unlock()
+			if used == 0 {
+				t.Fatalf("sequential read prefetched nothing")
+			}
+
+			// a renamed file is read from its new key, the reader of the
+			// old one gives its prefetched data back
+			renameTest(t, rootDir(fs), "f", rootDir(fs), "g")
+			off := 3 * ChunkCacheFixedSize
+			if got := readTest(t, h, int64(off), 1000); !bytes.Equal(got, data[off:off+1000]) {
+				t.Fatalf("read after rename read back wrong data")
+			}
+			releaseTest(t, h)
+			waitUsed(t, fs.readahead, 0)
+		})
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
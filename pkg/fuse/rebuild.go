@@ -0,0 +1,272 @@
+package fuse
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/meta"
+	"k8s.io/klog/v2"
+)
+
+const metaSuffix = "/.meta"
+
+// rebuilt collects the tree a rebuild creates under root, it is stored at
+// once when it is complete.
+type rebuilt struct {
+	root     *Dir
+	inodes   []*meta.Inode
+	dentries []meta.Dentry
+}
+
+func (r *rebuilt) create(parent uint64, name string, i *meta.Inode) {
+	r.inodes = append(r.inodes, i)
+	r.dentries = append(r.dentries, meta.Dentry{Parent: parent, Name: name, Ino: i.Ino})
+}
+
+// rebuild walks the bucket and recreates the Dir/File tree under root.
+// Keys ending with "/" are directories, a <key>/.meta object marks a chunked
+// file whose <key>/N chunks are hidden, every other key is a plain file. A
+// directory hides a file of the same name, as it does in Lookup. The shared
+// chunks under reservedPrefix are hidden too, the rebuild fails for any
+// other object there. The tree is stored along with the root inode in one
+// transaction, so an interrupted rebuild leaves nothing behind.
+func (fs *FileSystem) rebuild(root *Dir, rootInode *meta.Inode) error {
+	objs, err := fs.Backend.List("")
+	if err != nil {
+		return err
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].Key < objs[j].Key
+	})
+
+	chunked := make(map[string]bool)
+	for _, o := range objs {
+		if strings.HasSuffix(o.Key, metaSuffix) {
+			chunked[strings.TrimSuffix(o.Key, metaSuffix)] = true
+		}
+	}
+
+	r := &rebuilt{root: root}
+	for _, o := range objs {
+		if err := checkReserved(o.Key); err != nil {
+			return err
+		}
+		if o.Key == "" || strings.HasPrefix(o.Key, reservedPrefix) {
+			continue
+		}
+		var p string
+		switch {
+		case strings.HasSuffix(o.Key, metaSuffix):
+			p = parentKey(strings.TrimSuffix(o.Key, metaSuffix))
+		case isChunkPart(chunked, o.Key):
+			continue
+		case o.IsDir:
+			p = strings.TrimSuffix(o.Key, "/")
+		default:
+			p = parentKey(o.Key)
+		}
+		if _, err := fs.rebuildDir(r, p, o.Mtime); err != nil {
+			return err
+		}
+	}
+
+	for _, o := range objs {
+		if o.Key == "" || o.IsDir || isChunkPart(chunked, o.Key) || strings.HasPrefix(o.Key, reservedPrefix) {
+			continue
+		}
+		target := ""
+		if o.Size == 0 {
+			target = fs.symlinkTarget(o.Key)
+		}
+		if err := fs.rebuildFile(r, o.Key, uint64(o.Size), o.Mtime, nil, target); err != nil {
+			return err
+		}
+	}
+
+	for _, o := range objs {
+		if !strings.HasSuffix(o.Key, metaSuffix) {
+			continue
+		}
+		key := strings.TrimSuffix(o.Key, metaSuffix)
+		m, err := getManifest(fs.Backend, key)
+		if err != nil {
+			klog.Errorf("Rebuild skip %s, read chunk layout error %v", key, err)
+			continue
+		}
+		layout, err := m.layout()
+		if err != nil {
+			klog.Errorf("Rebuild skip %s, encode chunk layout error %v", key, err)
+			continue
+		}
+		if err := fs.rebuildFile(r, key, uint64(m.Size), o.Mtime, layout, ""); err != nil {
+			return err
+		}
+	}
+	return fs.meta.CreateAll(append(r.inodes, rootInode), r.dentries)
+}
+
+// parentKey returns the key of the directory holding key.
+func parentKey(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// checkReserved fails for an object that collides with those of the file
+// system, that is any object named reservedPrefix or under it other than the
+// chunks.
+func checkReserved(key string) error {
+	if key+"/" != reservedPrefix && !strings.HasPrefix(key, reservedPrefix) {
+		return nil
+	}
+	if key == reservedPrefix || key == chunkPrefix || isChunkKey(key) {
+		return nil
+	}
+	return fmt.Errorf("object %s collides with the prefix %s reserved for the file system", key, reservedPrefix)
+}
+
+// isChunkKey reports whether key names a shared chunk.
+func isChunkKey(key string) bool {
+	hash := strings.TrimPrefix(key, chunkPrefix)
+	if len(hash) != len(key)-len(chunkPrefix) || len(hash) != 2*len(ID{}) {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// isChunkPart reports whether key belongs to a chunked file, including the
+// placeholder object written at the file key itself.
+func isChunkPart(chunked map[string]bool, key string) bool {
+	if chunked[key] {
+		return true
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] != '/' {
+			continue
+		}
+		if chunked[key[:i]] {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *FileSystem) rebuildDir(r *rebuilt, p string, mtime time.Time) (*Dir, error) {
+	d := r.root
+	if p == "" {
+		return d, nil
+	}
+next:
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		for _, dd := range d.DirChild {
+			if dd.name == name {
+				d = dd
+				continue next
+			}
+		}
+		ino, err := fs.GenerateInode()
+		if err != nil {
+			return nil, err
+		}
+		dir := &Dir{
+			id:     ino,
+			parent: d,
+			name:   name,
+			typ:    fuse.DT_Dir,
+			fs:     fs,
+			attr: &fuse.Attr{
+				Valid:     time.Second,
+				Inode:     ino,
+				Size:      4 << 10,
+				Atime:     mtime,
+				Mtime:     mtime,
+				Ctime:     mtime,
+				Mode:      os.ModeDir | 0755,
+				Nlink:     2,
+				BlockSize: 512,
+			},
+		}
+		r.create(d.id, name, toInode(ino, dir.typ, dir.attr))
+		d.DirChild = append(d.DirChild, dir)
+		d = dir
+	}
+	return d, nil
+}
+
+// symlinkTarget returns the target mirrored in the metadata of an empty
+// object, or "" if the object is not a symlink.
+func (fs *FileSystem) symlinkTarget(key string) string {
+	o, err := fs.Backend.Head(key)
+	if err != nil {
+		return ""
+	}
+	for k, v := range o.Metadata {
+		if strings.ToLower(k) != SymlinkKey {
+			continue
+		}
+		target, err := url.PathUnescape(v)
+		if err != nil {
+			klog.Errorf("Rebuild symlink %s decode target error %v", key, err)
+			return ""
+		}
+		return target
+	}
+	return ""
+}
+
+func (fs *FileSystem) rebuildFile(r *rebuilt, key string, size uint64, mtime time.Time, layout []byte, target string) error {
+	dirKey := parentKey(key)
+	name := strings.TrimPrefix(key[len(dirKey):], "/")
+	d, err := fs.rebuildDir(r, dirKey, mtime)
+	if err != nil {
+		return err
+	}
+	for _, dd := range d.DirChild {
+		if dd.name == name {
+			klog.Warningf("Rebuild skip file %s, a directory has the same name", key)
+			return nil
+		}
+	}
+	ino, err := fs.GenerateInode()
+	if err != nil {
+		return err
+	}
+	f := newFile(d, name, &Inode{
+		id:  ino,
+		typ: fuse.DT_File,
+		fs:  fs,
+		attr: &fuse.Attr{
+			Valid: time.Second,
+			Inode: ino,
+			Size:  size,
+			Atime: mtime,
+			Mtime: mtime,
+			Ctime: mtime,
+			Mode:  0644,
+			Nlink: 1,
+		},
+	})
+	if target != "" {
+		f.typ = fuse.DT_Link
+		f.target = target
+		f.attr.Size = uint64(len(target))
+		f.attr.Mode = os.ModeSymlink | 0777
+	}
+	i := toInode(ino, f.typ, f.attr)
+	i.Layout = layout
+	i.Target = target
+	r.create(d.id, name, i)
+	d.FileChild = append(d.FileChild, f)
+	return nil
+}
@@ -0,0 +1,123 @@
+package fuse
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+	"github.com/nevermore/muyifs/pkg/meta"
+)
+
+func TestRebuild(t *testing.T) {
+	store := mem.NewMemClient("rebuild")
+	fs := mountTest(t, store, t.TempDir(), true, true, "")
+	dn, err := rootDir(fs).Mkdir(ctx, &fuse.MkdirRequest{Name: "d", Mode: 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunked := testData(ChunkCacheFixedSize+1000, 1)
+	writeFile(t, dn.(*Dir), "f", chunked)
+	if _, err := rootDir(fs).Symlink(ctx, &fuse.SymlinkRequest{NewName: "l", Target: "d/f"}); err != nil {
+		t.Fatal(err)
+	}
+	// objects written by other tools
+	plain := testData(1000, 2)
+	store.Put("plain", nil, bytes.NewReader(plain))
+	store.Put("x/y/z", nil, bytes.NewReader(plain[:10]))
+	store.PutDirectory("e/")
+
+	fs = mountTest(t, store, t.TempDir(), false, true, "")
+	root := rootDir(fs)
+	if got, want := names(root), []string{"d/", "e/", "l", "plain", "x/"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rebuilt root = %v, want %v", got, want)
+	}
+	d := lookupTest(t, root, "d").(*Dir)
+	if got, want := names(d), []string{"f"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rebuilt d = %v, want %v", got, want)
+	}
+	f := lookupTest(t, d, "f").(*File)
+	if f.attr.Size != uint64(len(chunked)) {
+		t.Fatalf("chunked file has size %d, want %d", f.attr.Size, len(chunked))
+	}
+	if !bytes.Equal(readFile(t, f), chunked) {
+		t.Fatalf("chunked file read back wrong data")
+	}
+	if got := readFile(t, lookupTest(t, root, "plain").(*File)); !bytes.Equal(got, plain) {
+		t.Fatalf("plain file read back wrong data")
+	}
+	l := lookupTest(t, root, "l").(*File)
+	if target, err := l.Readlink(ctx, &fuse.ReadlinkRequest{}); err != nil || target != "d/f" || l.typ != fuse.DT_Link {
+		t.Fatalf("rebuilt symlink = %q %v, type %v", target, err, l.typ)
+	}
+	y := lookupTest(t, lookupTest(t, root, "x").(*Dir), "y").(*Dir)
+	if got := readFile(t, lookupTest(t, y, "z").(*File)); !bytes.Equal(got, plain[:10]) {
+		t.Fatalf("x/y/z read back %q", got)
+	}
+}
+
+func TestReloadKeepsMetadata(t *testing.T) {
+	store := mem.NewMemClient("reload")
+	datapath := t.TempDir()
+	fs := mountTest(t, store, datapath, false, true, "")
+	data := testData(3000, 3)
+	writeFile(t, rootDir(fs), "a", data)
+	fs.meta.Close()
+
+	// Only a mount without metadata looks at the bucket.
+	store.Put("b", nil, bytes.NewReader(data))
+	fs = mountTest(t, store, datapath, false, true, "")
+	if got, want := names(rootDir(fs)), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded root = %v, want %v", got, want)
+	}
+	if got := readFile(t, lookupTest(t, rootDir(fs), "a").(*File)); !bytes.Equal(got, data) {
+		t.Fatalf("reloaded file read back wrong data")
+	}
+}
+
+func TestRebuildNameCollision(t *testing.T) {
+	store := mem.NewMemClient("collision")
+	data := testData(100, 4)
+	store.Put("a", nil, bytes.NewReader(data))
+	store.PutDirectory("a/")
+	store.Put("b", nil, bytes.NewReader(data))
+	store.Put("b/c", nil, bytes.NewReader(data))
+
+	// a directory hides the file of the same name, as in Lookup
+	fs := mountTest(t, store, t.TempDir(), false, true, "")
+	root := rootDir(fs)
+	if got, want := names(root), []string{"a/", "b/"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rebuilt root = %v, want %v", got, want)
+	}
+	entries, err := fs.meta.ReadDir(meta.RootInode)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("stored root entries = %+v, %v", entries, err)
+	}
+	if got := names(lookupTest(t, root, "b").(*Dir)); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Fatalf("rebuilt b = %v", got)
+	}
+}
+
+func TestRebuildInterrupted(t *testing.T) {
+	store := mem.NewMemClient("interrupted")
+	store.Put("!a", nil, bytes.NewReader([]byte("data")))
+	store.Put(reservedPrefix+"x", nil, bytes.NewReader([]byte("user data")))
+	datapath := t.TempDir()
+	fs := NewFileSystem("/mnt", datapath, "", false, true, &Option{})
+	fs.Backend = store
+	if _, err := fs.reloadData("/mnt"); err == nil {
+		t.Fatalf("rebuild with a colliding object succeeded")
+	}
+	// the entries rebuilt before the failure are not stored
+	if entries, err := fs.meta.ReadDir(meta.RootInode); err != nil || len(entries) != 0 {
+		t.Fatalf("failed rebuild stored %+v, %v", entries, err)
+	}
+	fs.meta.Close()
+
+	store.Delete(reservedPrefix + "x")
+	fs = mountTest(t, store, datapath, false, true, "")
+	if got, want := names(rootDir(fs)), []string{"!a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rebuilt root = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,521 @@
+package fuse
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	stagingDir       = "staging"
+	stagingBlockSize = 1 << 20
+)
+
+// removeStaging deletes the staging files a mount left behind when it did
+// not shut down cleanly. Their writes never reached the backend, and no
+// other mount uses the data path while this one holds its metadata.
+func removeStaging(datapath string) error {
+	return os.RemoveAll(filepath.Join(datapath, stagingDir))
+}
+
+type extent struct {
+	start int64
+	end   int64
+}
+
+// addExtent inserts [start, end) into the sorted extents es, merging it
+// with the extents it overlaps or touches.
+func addExtent(es []extent, start, end int64) []extent {
+	var out []extent
+	i := 0
+	for ; i < len(es) && es[i].end < start; i++ {
+		out = append(out, es[i])
+	}
+	for ; i < len(es) && es[i].start <= end; i++ {
+		if es[i].start < start {
+			start = es[i].start
+		}
+		if es[i].end > end {
+			end = es[i].end
+		}
+	}
+	out = append(out, extent{start: start, end: end})
+	return append(out, es[i:]...)
+}
+
+// StagingWriter takes writes at any offset. Dirty ranges are kept in a
+// local sparse file and merged with the stored data of the file at flush.
+// A plain object is uploaded again as a whole, a chunked file only gets
+// its dirty chunks uploaded again. Sequential writes from the end of the
+// stored data skip the staging file and stream to the backend, appending
+// to what is stored.
+type StagingWriter struct {
+	f      *File
+	reader CommonReader
+	// newWriter returns a writer that keeps the first base bytes stored.
+	newWriter func(base int64) (CommonWriter, error)
+	// writer is the open stream, next is the end of the data streamed to it.
+	writer CommonWriter
+	next   int64
+	// stored is the size of the data in the backend.
+	stored   int64
+	size     int64
+	file     *os.File
+	dirty    []extent
+	errState bool
+}
+
+func NewStagingWriter(f *File, reader CommonReader, newWriter func(base int64) (CommonWriter, error)) *StagingWriter {
+	return &StagingWriter{
+		f:         f,
+		reader:    reader,
+		newWriter: newWriter,
+		stored:    int64(f.attr.Size),
+		size:      int64(f.attr.Size),
+	}
+}
+
+func (s *StagingWriter) staged() bool {
+	return s.file != nil
+}
+
+// streaming tells whether sequential writes are open in a stream, they can
+// only be read back once it is flushed.
+func (s *StagingWriter) streaming() bool {
+	return s.writer != nil
+}
+
+// pending tells whether there are writes that Flush has to store.
+func (s *StagingWriter) pending() bool {
+	return s.writer != nil || s.file != nil
+}
+
+func (s *StagingWriter) openFile() error {
+	dir := filepath.Join(s.f.fs.datapath, stagingDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, strconv.FormatUint(s.f.id, 10)+"-")
+	if err != nil {
+		return err
+	}
+	s.file = file
+	return nil
+}
+
+func (s *StagingWriter) closeFile() {
+	if s.file == nil {
+		return
+	}
+	s.file.Close()
+	if err := os.Remove(s.file.Name()); err != nil {
+		klog.Errorf("Remove staging file %v error %v", s.file.Name(), err)
+	}
+	s.file = nil
+	s.dirty = nil
+}
+
+func (s *StagingWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	if s.errState {
+		return 0, fmt.Errorf("staging is in error state")
+	}
+
+	if !s.staged() {
+		if s.writer == nil && off == s.stored {
+			w, err := s.newWriter(s.stored)
+			if err != nil {
+				s.errState = true
+				klog.Errorf("Append to %v error %v", s.f.dataKey(), err)
+				return 0, err
+			}
+			s.writer, s.next = w, s.stored
+		}
+		if s.writer != nil && off == s.next {
+			n, err = s.writer.WriteAt(p, off)
+			s.next += int64(n)
+			return n, err
+		}
+		// Finish the stream first, the staged writes are merged with it.
+		if s.writer != nil {
+			if err := s.flushStream(); err != nil {
+				return 0, err
+			}
+		}
+		if err := s.openFile(); err != nil {
+			klog.Errorf("Open staging file error %v", err)
+			return 0, err
+		}
+	}
+
+	n, err = s.file.WriteAt(p, off)
+	if err != nil {
+		s.errState = true
+		klog.Errorf("Write staging file error %v", err)
+		return n, err
+	}
+	end := off + int64(n)
+	s.dirty = addExtent(s.dirty, off, end)
+	if end > s.size {
+		s.size = end
+	}
+	return n, nil
+}
+
+// ReadAt reads the file as it will be after the next flush.
+func (s *StagingWriter) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.size-off {
+		p = p[:s.size-off]
+	}
+	pos, end := off, off+int64(len(p))
+	for _, e := range s.dirty {
+		if e.end <= pos {
+			continue
+		}
+		if e.start >= end {
+			break
+		}
+		if e.start > pos {
+			if err := s.readClean(p[pos-off:e.start-off], pos); err != nil {
+				return 0, err
+			}
+			pos = e.start
+		}
+		to := e.end
+		if to > end {
+			to = end
+		}
+		if _, err := s.file.ReadAt(p[pos-off:to-off], pos); err != nil {
+			return 0, err
+		}
+		pos = to
+	}
+	if pos < end {
+		if err := s.readClean(p[pos-off:], pos); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// readClean reads a range without dirty data, from the stored data or as
+// zeros past its end.
+func (s *StagingWriter) readClean(p []byte, off int64) error {
+	n := int64(0)
+	if off < s.stored {
+		n = s.stored - off
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		if _, err := s.reader.ReadAt(p[:n], off); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	for i := n; i < int64(len(p)); i++ {
+		p[i] = 0
+	}
+	return nil
+}
+
+func (s *StagingWriter) flushStream() error {
+	if err := s.writer.Flush(); err != nil {
+		s.errState = true
+		return err
+	}
+	if s.next > s.size {
+		s.size = s.next
+	}
+	s.stored = s.next
+	s.writer = nil
+	s.reader.Release()
+	return nil
+}
+
+func (s *StagingWriter) Flush() error {
+	if s.errState {
+		return fmt.Errorf("staging is in error state")
+	}
+	if !s.staged() {
+		if s.writer == nil {
+			return nil
+		}
+		return s.flushStream()
+	}
+	merge := s.merge
+	if _, ok := s.reader.(*ChunkReader); ok {
+		merge = s.mergeChunks
+	}
+	if err := merge(); err != nil {
+		s.errState = true
+		klog.Errorf("Merge staging file of %v error %v", s.f.dataKey(), err)
+		return err
+	}
+	s.closeFile()
+	s.stored = s.size
+	s.reader.Release()
+	return nil
+}
+
+// merge completes the staging file with the clean ranges of the stored
+// data and uploads it from the start.
+func (s *StagingWriter) merge() error {
+	buf := make([]byte, stagingBlockSize)
+	var pos int64
+	gaps := append(append([]extent(nil), s.dirty...), extent{start: s.stored, end: s.stored})
+	for _, e := range gaps {
+		for pos < e.start && pos < s.stored {
+			n := e.start - pos
+			if n > stagingBlockSize {
+				n = stagingBlockSize
+			}
+			if pos+n > s.stored {
+				n = s.stored - pos
+			}
+			if err := s.readClean(buf[:n], pos); err != nil {
+				return err
+			}
+			if _, err := s.file.WriteAt(buf[:n], pos); err != nil {
+				return err
+			}
+			pos += n
+		}
+		if e.end > pos {
+			pos = e.end
+		}
+	}
+
+	w, err := s.newWriter(0)
+	if err != nil {
+		return err
+	}
+	defer w.Release()
+	for off := int64(0); off < s.size; {
+		n := s.size - off
+		if n > stagingBlockSize {
+			n = stagingBlockSize
+		}
+		m, err := s.file.ReadAt(buf[:n], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for i := m; i < int(n); i++ {
+			buf[i] = 0
+		}
+		if _, err := w.WriteAt(buf[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return w.Flush()
+}
+
+// mergeChunks re-uploads only the chunks of a chunked file that hold dirty
+// data, cut the way the stored layout was cut.
+func (s *StagingWriter) mergeChunks() error {
+	cw, err := s.newWriter(0)
+	if err != nil {
+		return err
+	}
+	defer cw.Release()
+	w, ok := cw.(*ChunkWriter)
+	if !ok {
+		return fmt.Errorf("staging of %v has no chunk writer", s.f.dataKey())
+	}
+	var metas []ChunkMeta
+	if s.stored > 0 {
+		r := s.reader.(*ChunkReader)
+		if r.manifest == nil {
+			if err := r.doInit(); err != nil {
+				return err
+			}
+		}
+		w.configure(r.manifest)
+		for _, m := range r.ChunkMetas {
+			if m.Start < m.End {
+				metas = append(metas, m)
+			}
+		}
+	}
+
+	var replaced []ChunkMeta
+	if w.isFixed {
+		metas, replaced, err = s.mergeFixed(w, metas)
+	} else {
+		metas, replaced, err = s.mergeDynamic(w, metas)
+	}
+	if err != nil {
+		return err
+	}
+	var end int64
+	if n := len(metas); n > 0 {
+		end = metas[n-1].End
+	}
+	metas = append(metas, ChunkMeta{
+		Index: len(metas),
+		Start: end,
+	})
+	if err := w.putLayout(metas); err != nil {
+		return err
+	}
+	s.f.fs.dropChunks(s.f.dataKey(), replaced)
+	return nil
+}
+
+// dirtyChunk tells whether m overlaps the dirty data.
+func (s *StagingWriter) dirtyChunk(m ChunkMeta) bool {
+	for _, e := range s.dirty {
+		if m.Start < e.end && e.start < m.End {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFixed stores the dirty chunks of a fixed size layout again in
+// place. A short last chunk is filled up to ChunkCacheFixedSize and the
+// rest of the data is added as new chunks after it. It returns the new
+// chunks and the stored chunks they replace.
+func (s *StagingWriter) mergeFixed(w *ChunkWriter, metas []ChunkMeta) ([]ChunkMeta, []ChunkMeta, error) {
+	kept := len(metas)
+	rewrite := make(map[int]bool)
+	var end int64
+	if n := len(metas); n > 0 {
+		end = metas[n-1].End
+		if last := &metas[n-1]; end < s.size && last.End-last.Start < ChunkCacheFixedSize {
+			last.End = last.Start + ChunkCacheFixedSize
+			if last.End > s.size {
+				last.End = s.size
+			}
+			end = last.End
+			rewrite[last.Index] = true
+		}
+	}
+	for end < s.size {
+		n := s.size - end
+		if n > ChunkCacheFixedSize {
+			n = ChunkCacheFixedSize
+		}
+		metas = append(metas, ChunkMeta{
+			Index: len(metas),
+			Start: end,
+			End:   end + n,
+		})
+		rewrite[len(metas)-1] = true
+		end += n
+	}
+	for _, m := range metas {
+		if s.dirtyChunk(m) {
+			rewrite[m.Index] = true
+		}
+	}
+
+	var buf []byte
+	var replaced []ChunkMeta
+	for i := range metas {
+		m := &metas[i]
+		if !rewrite[m.Index] {
+			continue
+		}
+		if i < kept {
+			replaced = append(replaced, *m)
+		}
+		if n := m.End - m.Start; int64(len(buf)) < n {
+			buf = make([]byte, n)
+		}
+		data := buf[:m.End-m.Start]
+		if _, err := s.ReadAt(data, m.Start); err != nil {
+			return nil, nil, err
+		}
+		n, id, err := w.putChunk(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.CompressSize = n
+		m.Hash = id.String()
+		m.Hole = false
+	}
+	return metas, replaced, nil
+}
+
+// mergeDynamic cuts each run of dirty chunks of a content defined layout
+// again with the chunker, a run that reaches the last chunk goes on to the
+// end of the data. Clean chunks keep their boundaries. It returns the new
+// chunks and the stored chunks they replace.
+func (s *StagingWriter) mergeDynamic(w *ChunkWriter, metas []ChunkMeta) ([]ChunkMeta, []ChunkMeta, error) {
+	var out, replaced []ChunkMeta
+	buf := make([]byte, w.maxSize)
+	cut := func(start, end int64) error {
+		w.chnker.ResetWithBoundaries(io.NewSectionReader(s, start, end-start), w.pol, w.minSize, w.maxSize)
+		w.chnker.SetAverageBits(w.avgBits)
+		for off := start; ; {
+			c, err := w.chnker.Next(buf)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			n, id, err := w.putChunk(c.Data)
+			if err != nil {
+				return err
+			}
+			out = append(out, ChunkMeta{
+				Index:        len(out),
+				Start:        off,
+				End:          off + int64(c.Length),
+				CompressSize: n,
+				Hash:         id.String(),
+			})
+			off += int64(c.Length)
+		}
+	}
+
+	run := int64(-1)
+	for i, m := range metas {
+		dirty := s.dirtyChunk(m) || (i == len(metas)-1 && m.End < s.size)
+		if !dirty && run >= 0 {
+			if err := cut(run, m.Start); err != nil {
+				return nil, nil, err
+			}
+			run = -1
+		}
+		if !dirty && m.Hash == "" && !m.Hole && m.Index != len(out) {
+			// a chunk stored under its index can not move
+			dirty = true
+		}
+		if dirty {
+			replaced = append(replaced, m)
+			if run < 0 {
+				run = m.Start
+			}
+			continue
+		}
+		m.Index = len(out)
+		out = append(out, m)
+	}
+	if run < 0 && len(metas) == 0 {
+		run = 0
+	}
+	if run >= 0 {
+		if err := cut(run, s.size); err != nil {
+			return nil, nil, err
+		}
+	}
+	return out, replaced, nil
+}
+
+func (s *StagingWriter) Release() {
+	if s.writer != nil {
+		s.writer.Release()
+		s.writer = nil
+	}
+	s.closeFile()
+	s.next = 0
+	s.errState = false
+}
@@ -0,0 +1,206 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+	"github.com/restic/chunker"
+)
+
+func stagingFiles(t *testing.T, datapath string) []os.FileInfo {
+	t.Helper()
+	infos, err := ioutil.ReadDir(filepath.Join(datapath, stagingDir))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return infos
+}
+
+func TestStagingRandomWrites(t *testing.T) {
+	for _, c := range append([]chunking{{}}, chunkings...) {
+		chunk := c != chunking{}
+		t.Run(fmt.Sprintf("chunk=%v,%v", chunk, c), func(t *testing.T) {
+			datapath := t.TempDir()
+			fs := mountTest(t, mem.NewMemClient("t"), datapath, chunk, c.fixed, c.compress)
+			data := testData(ChunkCacheFixedSize+5000, 10)
+			f := writeFile(t, rootDir(fs), "f", data)
+
+			h := openTest(t, f, fuse.OpenReadWrite)
+			for i, w := range []struct {
+				off int
+				n   int
+			}{{3000, 100}, {10, 5000}, {ChunkCacheFixedSize - 10, 20}, {len(data) - 10, 2000}, {20, 10}} {
+				p := testData(w.n, int64(20+i))
+				writeTest(t, h, p, int64(w.off))
+				if end := w.off + w.n; end > len(data) {
+					data = append(data, make([]byte, end-len(data))...)
+				}
+				copy(data[w.off:], p)
+			}
+			if len(stagingFiles(t, datapath)) != 1 {
+				t.Fatalf("random writes are not staged")
+			}
+			if got := readTest(t, h, 0, len(data)); !bytes.Equal(got, data) {
+				t.Fatalf("staged data read back wrong")
+			}
+			flushTest(t, h)
+			releaseTest(t, h)
+			if n := len(stagingFiles(t, datapath)); n != 0 {
+				t.Fatalf("flush left %d staging files", n)
+			}
+			if f.attr.Size != uint64(len(data)) || !bytes.Equal(readFile(t, f), data) {
+				t.Fatalf("flushed random writes read back wrong data")
+			}
+		})
+	}
+}
+
+func TestReadStreamedWrites(t *testing.T) {
+	for _, c := range append([]chunking{{}}, chunkings...) {
+		chunk := c != chunking{}
+		t.Run(fmt.Sprintf("chunk=%v,%v", chunk, c), func(t *testing.T) {
+			fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), chunk, c.fixed, c.compress)
+			f, h := createTest(t, rootDir(fs), "f")
+			data := []byte("hello world")
+			writeTest(t, h, data, 0)
+			// sequential writes still streaming are read back before close
+			if got := readTest(t, h, 0, 100); !bytes.Equal(got, data) {
+				t.Fatalf("unflushed writes read back %q", got)
+			}
+			more := testData(ChunkCacheFixedSize+1000, 11)
+			writeTest(t, h, more, int64(len(data)))
+			data = append(data, more...)
+			if got := readTest(t, h, 0, len(data)+100); !bytes.Equal(got, data) {
+				t.Fatalf("appended writes read back wrong data")
+			}
+			flushTest(t, h)
+			releaseTest(t, h)
+			if !bytes.Equal(readFile(t, f), data) {
+				t.Fatalf("flushed writes read back wrong data")
+			}
+		})
+	}
+}
+
+func TestRemoveStagingAtMount(t *testing.T) {
+	store := mem.NewMemClient("t")
+	datapath := t.TempDir()
+	fs := mountTest(t, store, datapath, false, true, "")
+	f := writeFile(t, rootDir(fs), "f", testData(1000, 11))
+	h := openTest(t, f, fuse.OpenReadWrite)
+	writeTest(t, h, []byte("x"), 10)
+	if len(stagingFiles(t, datapath)) != 1 {
+		t.Fatalf("random write is not staged")
+	}
+	// the mount goes away without flushing
+	fs.meta.Close()
+
+	mountTest(t, store, datapath, false, true, "")
+	if n := len(stagingFiles(t, datapath)); n != 0 {
+		t.Fatalf("mount left %d staging files", n)
+	}
+}
+
+// layoutTest returns the stored chunks of f.
+func layoutTest(t *testing.T, f *File) []ChunkMeta {
+	t.Helper()
+	m, err := f.fs.loadManifest(f.id, f.dataKey())
+	if err != nil {
+		t.Fatalf("load layout of %s: %v", f.name, err)
+	}
+	var chunks []ChunkMeta
+	for _, c := range m.Chunks {
+		if c.Start < c.End {
+			chunks = append(chunks, c)
+		}
+	}
+	return chunks
+}
+
+func TestMergeChunksFixed(t *testing.T) {
+	fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), true, true, "")
+	data := testData(3*ChunkCacheFixedSize, 14)
+	f := writeFile(t, rootDir(fs), "f", data)
+	before := layoutTest(t, f)
+
+	h := openTest(t, f, fuse.OpenReadWrite)
+	off := ChunkCacheFixedSize + 1000
+	writeTest(t, h, []byte("changed"), int64(off))
+	copy(data[off:], "changed")
+	flushTest(t, h)
+	releaseTest(t, h)
+	if !bytes.Equal(readFile(t, f), data) {
+		t.Fatalf("merged file read back wrong data")
+	}
+	after := layoutTest(t, f)
+	if len(after) != 3 || after[1].Hash == before[1].Hash {
+		t.Fatalf("dirty chunk was not stored again: %+v", after)
+	}
+	for _, i := range []int{0, 2} {
+		if !reflect.DeepEqual(after[i], before[i]) {
+			t.Fatalf("clean chunk %d changed from %+v to %+v", i, before[i], after[i])
+		}
+	}
+}
+
+func TestMergeChunksDynamic(t *testing.T) {
+	fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), true, false, "")
+	root := rootDir(fs)
+	data := testData(3*chunkerMaxSize, 12)
+	f := writeFile(t, root, "f", data)
+	before := layoutTest(t, f)
+	if len(before) < 3 {
+		t.Fatalf("test data is cut into %d chunks", len(before))
+	}
+
+	// a write in the second chunk and one past the end
+	h := openTest(t, f, fuse.OpenReadWrite)
+	off := int(before[1].Start) + 1000
+	writeTest(t, h, []byte("changed"), int64(off))
+	copy(data[off:], "changed")
+	tail := testData(2*chunkerMaxSize, 13)
+	writeTest(t, h, tail, int64(len(data)+100))
+	data = append(append(data, make([]byte, 100)...), tail...)
+	flushTest(t, h)
+	releaseTest(t, h)
+	if !bytes.Equal(readFile(t, f), data) {
+		t.Fatalf("merged file read back wrong data")
+	}
+
+	after := layoutTest(t, f)
+	if !reflect.DeepEqual(after[0], before[0]) {
+		t.Fatalf("clean chunk changed from %+v to %+v", before[0], after[0])
+	}
+	// The tail is cut by content from the start of the last stored chunk.
+	start := before[len(before)-1].Start
+	c := chunker.NewWithBoundaries(bytes.NewReader(data[start:]), chunkerPol, chunkerMinSize, chunkerMaxSize)
+	c.SetAverageBits(chunkerAvgBits)
+	var want []int64
+	for {
+		chunk, err := c.Next(make([]byte, chunkerMaxSize))
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		start += int64(chunk.Length)
+		want = append(want, start)
+	}
+	var got []int64
+	for _, m := range after {
+		if m.End > before[len(before)-1].Start {
+			got = append(got, m.End)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tail is cut at %v, want %v", got, want)
+	}
+}
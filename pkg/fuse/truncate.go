@@ -0,0 +1,199 @@
+package fuse
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+	"k8s.io/klog/v2"
+)
+
+// truncate cuts the data of f to size bytes or extends it with zeros. Open
+// handles are flushed first and follow the new data afterwards.
+func (f *File) truncate(size uint64) error {
+	f.fs.Lock()
+	of := f.fs.files[f.id]
+	f.fs.Unlock()
+	if of != nil {
+		of.Lock()
+		defer of.Unlock()
+		if err := of.writer.Flush(); err != nil {
+			return err
+		}
+	}
+
+	key := f.dataKey()
+	var chunked bool
+	if of != nil {
+		chunked = of.chunked
+	} else {
+		chunked = f.isChunked(key)
+	}
+	var err error
+	if chunked {
+		err = f.fs.truncateChunks(f.id, key, int64(f.attr.Size), int64(size))
+	} else {
+		err = f.fs.truncateObject(key, int64(size))
+	}
+	if err != nil {
+		klog.Errorf("Truncate %v to %d error %v", key, size, err)
+		return err
+	}
+	if !chunked {
+		f.fs.invalidate(key)
+	}
+	f.attr.Size = size
+	if of != nil {
+		of.open(key)
+	}
+	return nil
+}
+
+// truncateObject rewrites the object key to size bytes, keeping the head of
+// its data and filling any extension with zeros.
+func (fs *FileSystem) truncateObject(key string, size int64) error {
+	o, err := fs.Backend.Head(key)
+	if err != nil {
+		return err
+	}
+	keep := o.Size
+	if size < keep {
+		keep = size
+	}
+	if size <= CacheSize && keep < UploadPartSize {
+		buf := make([]byte, size)
+		if err := fs.readFull(key, 0, buf[:keep]); err != nil {
+			return err
+		}
+		return fs.Backend.Put(key, o.Metadata, bytes.NewReader(buf))
+	}
+
+	// The object stays readable until the upload completes, so its old
+	// data can be copied into the upload on the server side. A head too
+	// small to be a part is read into the first part instead.
+	mu, err := fs.Backend.InitiateMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+	var parts []*backend.Part
+	off, num := int64(0), 1
+	if keep >= int64(mu.MinPartSize) {
+		if parts, num, err = fs.copyParts(key, mu, keep); err != nil {
+			return err
+		}
+		off = keep
+	}
+	var buf []byte
+	if off < size {
+		buf = make([]byte, CacheSize)
+	}
+	for ; off < size; off, num = off+CacheSize, num+1 {
+		part := buf
+		if size-off < CacheSize {
+			part = buf[:size-off]
+		}
+		var n int64
+		if off < keep {
+			n = keep - off
+			if n > int64(len(part)) {
+				n = int64(len(part))
+			}
+			if err := fs.readFull(key, off, part[:n]); err != nil {
+				fs.Backend.AbortUpload(key, mu.UploadID)
+				return err
+			}
+		}
+		for i := n; i < int64(len(part)); i++ {
+			part[i] = 0
+		}
+		p, err := fs.Backend.UploadPart(key, mu.UploadID, num, part)
+		if err != nil {
+			fs.Backend.AbortUpload(key, mu.UploadID)
+			return err
+		}
+		parts = append(parts, p)
+	}
+	return fs.Backend.CompleteUpload(key, mu.UploadID, parts)
+}
+
+func (fs *FileSystem) readFull(key string, off int64, buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	n, err := fs.Backend.Get(key, off, int64(len(buf)), buf)
+	if err != nil {
+		return err
+	}
+	if n < len(buf) {
+		klog.Errorf("Read %v short read %d < %d", key, n, len(buf))
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// truncateChunks cuts the chunk layout of a chunked file to size. Chunks
+// past size are dropped and the chunk holding size is stored again, a grown
+// tail is recorded as holes that are read back as zeros.
+func (fs *FileSystem) truncateChunks(ino uint64, key string, oldSize, size int64) error {
+	r := NewChunkReader(ino, key, fs, fs.compress, fs.isFixed).(*ChunkReader)
+	w := NewChunkWriter(ino, key, fs, fs.compress, fs.isFixed).(*ChunkWriter)
+	defer w.Release()
+	if oldSize > 0 {
+		if err := r.doInit(); err != nil {
+			return err
+		}
+		w.configure(r.manifest)
+	}
+
+	var metas, replaced []ChunkMeta
+	var end int64
+	for _, m := range r.ChunkMetas {
+		if m.Start >= m.End {
+			continue
+		}
+		if m.Start >= size {
+			replaced = append(replaced, m)
+			continue
+		}
+		if m.End > size && !m.Hole {
+			if err := r.doDownload(m.Index, r.c.buf); err != nil {
+				return err
+			}
+			replaced = append(replaced, m)
+			n, id, err := w.putChunk(r.c.buf[:size-m.Start])
+			if err != nil {
+				return err
+			}
+			m.CompressSize = n
+			m.Hash = id.String()
+		}
+		if m.End > size {
+			m.End = size
+		}
+		metas = append(metas, m)
+		end = m.End
+	}
+	// Holes are split so that each of them fits in the read cache.
+	for end < size {
+		n := size - end
+		if n > ChunkCacheFixedSize {
+			n = ChunkCacheFixedSize
+		}
+		metas = append(metas, ChunkMeta{
+			Index: len(metas),
+			Start: end,
+			End:   end + n,
+			Hole:  true,
+		})
+		end += n
+	}
+	metas = append(metas, ChunkMeta{
+		Index: len(metas),
+		Start: end,
+	})
+	if err := w.putLayout(metas); err != nil {
+		return err
+	}
+	fs.dropChunks(key, replaced)
+	return nil
+}
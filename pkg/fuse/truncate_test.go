@@ -0,0 +1,79 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+func truncateTest(t *testing.T, f *File, size int) {
+	t.Helper()
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: uint64(size)}
+	if err := f.Setattr(ctx, req, &fuse.SetattrResponse{}); err != nil {
+		t.Fatalf("truncate %s to %d: %v", f.name, size, err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, c := range append([]chunking{{}}, chunkings...) {
+		chunk := c != chunking{}
+		t.Run(fmt.Sprintf("chunk=%v,%v", chunk, c), func(t *testing.T) {
+			fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), chunk, c.fixed, c.compress)
+			data := testData(2*ChunkCacheFixedSize+1000, 7)
+			f := writeFile(t, rootDir(fs), "f", data)
+			// an open handle follows the new size
+			h := openTest(t, f, fuse.OpenReadOnly)
+			defer releaseTest(t, h)
+
+			for _, size := range []int{ChunkCacheFixedSize + 10, 100, 3 * ChunkCacheFixedSize, 0} {
+				truncateTest(t, f, size)
+				want := make([]byte, size)
+				copy(want, data)
+				data = want
+				if f.attr.Size != uint64(size) {
+					t.Fatalf("size after truncate to %d = %d", size, f.attr.Size)
+				}
+				if !bytes.Equal(readFile(t, f), data) {
+					t.Fatalf("truncate to %d read back wrong data", size)
+				}
+				if got := readTest(t, h, 0, size); !bytes.Equal(got, data) {
+					t.Fatalf("open handle read back %d bytes after truncate to %d", len(got), size)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateCopiesHead(t *testing.T) {
+	store := mem.NewMemClient("t")
+	fs := mountTest(t, store, t.TempDir(), false, true, "")
+	data := testData(UploadPartSize+(6<<20), 8)
+	f := writeFile(t, rootDir(fs), "f", data)
+
+	// The head is copied on the server side, reading it fails.
+	store.SetFaults(mem.Faults{TruncateGet: 1})
+	truncateTest(t, f, UploadPartSize+(5<<20))
+	store.SetFaults(mem.Faults{})
+	if !bytes.Equal(readFile(t, f), data[:UploadPartSize+(5<<20)]) {
+		t.Fatalf("truncated file read back wrong data")
+	}
+	if n := store.Uploads(); n != 0 {
+		t.Fatalf("truncate left %d multipart uploads", n)
+	}
+}
+
+func TestOpenTruncateSaveError(t *testing.T) {
+	fs := mountTest(t, mem.NewMemClient("t"), t.TempDir(), false, true, "")
+	f := writeFile(t, rootDir(fs), "f", testData(1000, 9))
+	fs.meta.Close()
+	req := &fuse.OpenRequest{Flags: fuse.OpenReadWrite | fuse.OpenTruncate}
+	if _, err := f.Open(ctx, req, &fuse.OpenResponse{}); err == nil {
+		t.Fatalf("open succeeded without metadata")
+	}
+	if len(fs.handler) != 0 || len(fs.files) != 0 {
+		t.Fatalf("failed open left %d handles and %d open files", len(fs.handler), len(fs.files))
+	}
+}
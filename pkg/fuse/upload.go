@@ -0,0 +1,188 @@
+package fuse
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// UploadPartSize is the size of the first parts uploaded by WriterAt,
+	// see partSize.
+	UploadPartSize = 1 << 24
+	// partGrowth is the number of times the part size doubles before the
+	// part count limit of an upload is reached.
+	partGrowth = 4
+	// UploadConcurrency is the number of parts or chunks a writer uploads
+	// at once.
+	UploadConcurrency = 4
+)
+
+// partUploader uploads the parts of a multipart upload in the background.
+// Parts are filled in a ring of buffers, a writer that wants a buffer while
+// UploadConcurrency parts are in flight waits for one of them to finish.
+type partUploader struct {
+	sync.Mutex
+	key      string
+	uploadID string
+	fs       *FileSystem
+	free     chan []byte
+	wg       sync.WaitGroup
+	parts    []*backend.Part
+	err      error
+}
+
+func newPartUploader(fs *FileSystem, key, uploadID string) *partUploader {
+	u := &partUploader{
+		key:      key,
+		uploadID: uploadID,
+		fs:       fs,
+		free:     make(chan []byte, UploadConcurrency+1),
+	}
+	// buffers are allocated when first taken
+	for i := 0; i < UploadConcurrency+1; i++ {
+		u.free <- nil
+	}
+	return u
+}
+
+// partSize returns the size of part num of an upload of at most maxCount
+// parts. Parts start at UploadPartSize and double partGrowth times, every
+// time another fifth of maxCount is used, so that a file may grow to about
+// six times the size that parts of UploadPartSize allow.
+func partSize(num, maxCount int) int {
+	step := maxCount / (partGrowth + 1)
+	if step < 1 {
+		step = 1
+	}
+	n := (num - 1) / step
+	if n > partGrowth {
+		n = partGrowth
+	}
+	return UploadPartSize << n
+}
+
+// buffer returns a free buffer of size bytes.
+func (u *partUploader) buffer(size int) []byte {
+	buf := <-u.free
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	return buf[:size]
+}
+
+// upload uploads body as part num and gives its buffer back to the ring.
+func (u *partUploader) upload(num int, body []byte) {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		part, err := u.fs.Backend.UploadPart(u.key, u.uploadID, num, body)
+		u.free <- body[:cap(body)]
+		u.Lock()
+		defer u.Unlock()
+		if err != nil {
+			klog.Errorf("Upload part %d of %v error %v", num, u.key, err)
+			if u.err == nil {
+				u.err = err
+			}
+			return
+		}
+		u.parts = append(u.parts, part)
+	}()
+}
+
+// error returns the first error of the uploads so far.
+func (u *partUploader) error() error {
+	u.Lock()
+	defer u.Unlock()
+	return u.err
+}
+
+// wait waits for all uploads and returns their parts in order.
+func (u *partUploader) wait() ([]*backend.Part, error) {
+	u.wg.Wait()
+	u.Lock()
+	defer u.Unlock()
+	sort.Slice(u.parts, func(i, j int) bool {
+		return u.parts[i].Num < u.parts[j].Num
+	})
+	return u.parts, u.err
+}
+
+// chunkUploader compresses, hashes and uploads the chunks of a ChunkWriter
+// in the background, from a ring of buffers like partUploader.
+type chunkUploader struct {
+	sync.Mutex
+	c    *ChunkWriter
+	size int
+	free chan []byte
+	wg   sync.WaitGroup
+	// stored holds the size and hash of each uploaded chunk.
+	stored map[int]ChunkMeta
+	err    error
+}
+
+func newChunkUploader(c *ChunkWriter, size int) *chunkUploader {
+	u := &chunkUploader{
+		c:      c,
+		size:   size,
+		free:   make(chan []byte, UploadConcurrency+1),
+		stored: make(map[int]ChunkMeta),
+	}
+	for i := 0; i < UploadConcurrency+1; i++ {
+		u.free <- nil
+	}
+	return u
+}
+
+// buffer returns a free buffer of at least size bytes.
+func (u *chunkUploader) buffer() []byte {
+	buf := <-u.free
+	if buf == nil {
+		buf = make([]byte, u.size)
+	}
+	return buf
+}
+
+// release gives back a buffer that was not uploaded.
+func (u *chunkUploader) release(buf []byte) {
+	u.free <- buf
+}
+
+// upload stores data as the chunk index and gives its buffer back to the
+// ring, the stored size is collected for the layout.
+func (u *chunkUploader) upload(index int, data []byte) {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		n, id, err := u.c.putChunk(data)
+		u.free <- data[:cap(data)]
+		u.Lock()
+		defer u.Unlock()
+		if err != nil {
+			klog.Errorf("Upload chunk %d of %v error %v", index, u.c.key, err)
+			if u.err == nil {
+				u.err = err
+			}
+			return
+		}
+		u.stored[index] = ChunkMeta{CompressSize: n, Hash: id.String()}
+	}()
+}
+
+func (u *chunkUploader) error() error {
+	u.Lock()
+	defer u.Unlock()
+	return u.err
+}
+
+// wait waits for all uploads and returns the stored size and hash of each
+// chunk.
+func (u *chunkUploader) wait() (map[int]ChunkMeta, error) {
+	u.wg.Wait()
+	u.Lock()
+	defer u.Unlock()
+	return u.stored, u.err
+}
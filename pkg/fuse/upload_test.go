@@ -0,0 +1,175 @@
+package fuse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nevermore/muyifs/pkg/backend"
+	"github.com/nevermore/muyifs/pkg/backend/mem"
+)
+
+// slowStore makes UploadPart and Put take a while and records how many of
+// them ran at once.
+type slowStore struct {
+	backend.ObjectStorage
+	sync.Mutex
+	running int
+	max     int
+}
+
+func (s *slowStore) call() func() {
+	s.Lock()
+	s.running++
+	if s.running > s.max {
+		s.max = s.running
+	}
+	s.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	return func() {
+		s.Lock()
+		s.running--
+		s.Unlock()
+	}
+}
+
+func (s *slowStore) UploadPart(key string, uploadID string, num int, body []byte) (*backend.Part, error) {
+	defer s.call()()
+	return s.ObjectStorage.UploadPart(key, uploadID, num, body)
+}
+
+func (s *slowStore) Put(key string, metadata map[string]string, in io.Reader) error {
+	defer s.call()()
+	return s.ObjectStorage.Put(key, metadata, in)
+}
+
+func TestPartUploader(t *testing.T) {
+	inner := mem.NewMemClient("t")
+	store := &slowStore{ObjectStorage: inner}
+	fs := mountTest(t, store, t.TempDir(), false, true, "")
+	mu, _ := store.InitiateMultipartUpload("k")
+	u := newPartUploader(fs, "k", mu.UploadID)
+	for num := 8; num > 0; num-- {
+		buf := u.buffer(UploadPartSize)
+		buf[0] = byte(num)
+		u.upload(num, buf[:1])
+	}
+	parts, err := u.wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range parts {
+		if p.Num != i+1 {
+			t.Fatalf("part %d has number %d", i, p.Num)
+		}
+	}
+	if store.max < 2 || store.max > UploadConcurrency+1 {
+		t.Fatalf("%d parts were uploaded at once", store.max)
+	}
+
+	inner.SetFaults(mem.Faults{FailUploadPart: 2})
+	u = newPartUploader(fs, "k", mu.UploadID)
+	for num := 1; num <= 3; num++ {
+		u.upload(num, u.buffer(1))
+	}
+	if _, err := u.wait(); err != mem.ErrInjected {
+		t.Fatalf("wait = %v, want the error of the failed part", err)
+	}
+	if err := u.error(); err != mem.ErrInjected {
+		t.Fatalf("error = %v, want the error of the failed part", err)
+	}
+}
+
+func TestChunkUploader(t *testing.T) {
+	inner := mem.NewMemClient("t")
+	store := &slowStore{ObjectStorage: inner}
+	fs := mountTest(t, store, t.TempDir(), true, true, "")
+	w := NewChunkWriter(2, "f", fs, "", true).(*ChunkWriter)
+	u := newChunkUploader(w, 100)
+	for i := 0; i < 8; i++ {
+		buf := u.buffer()
+		u.upload(i, buf[:copy(buf, fmt.Sprintf("chunk %d", i))])
+	}
+	stored, err := u.wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		want := ID(sha256.Sum256([]byte(fmt.Sprintf("chunk %d", i)))).String()
+		if m := stored[i]; m.Hash != want || m.CompressSize != int64(len("chunk 0")) {
+			t.Fatalf("chunk %d stored as %+v, want hash %s", i, m, want)
+		}
+	}
+	if store.max < 2 {
+		t.Fatalf("chunks were uploaded one at a time")
+	}
+
+	inner.SetFaults(mem.Faults{FailPut: 1})
+	u = newChunkUploader(w, 100)
+	buf := u.buffer()
+	u.upload(0, buf[:copy(buf, "other")])
+	if _, err := u.wait(); err != mem.ErrInjected {
+		t.Fatalf("wait = %v, want the error of the failed chunk", err)
+	}
+}
+
+// partLimit lowers the part count limit of multipart uploads and records
+// the size of the uploaded parts.
+type partLimit struct {
+	backend.ObjectStorage
+	sync.Mutex
+	max   int
+	sizes map[int]int
+}
+
+func (s *partLimit) InitiateMultipartUpload(key string) (*backend.MultipartUpload, error) {
+	mu, err := s.ObjectStorage.InitiateMultipartUpload(key)
+	if err == nil {
+		mu.MaxCount = s.max
+	}
+	return mu, err
+}
+
+func (s *partLimit) UploadPart(key string, uploadID string, num int, body []byte) (*backend.Part, error) {
+	s.Lock()
+	s.sizes[num] = len(body)
+	s.Unlock()
+	return s.ObjectStorage.UploadPart(key, uploadID, num, body)
+}
+
+func TestPartSize(t *testing.T) {
+	for _, c := range []struct {
+		num, maxCount, want int
+	}{{1, 10000, UploadPartSize}, {2000, 10000, UploadPartSize}, {2001, 10000, 2 * UploadPartSize},
+		{10000, 10000, 16 * UploadPartSize}, {1, 2, UploadPartSize}, {2, 2, 2 * UploadPartSize}} {
+		if got := partSize(c.num, c.maxCount); got != c.want {
+			t.Errorf("partSize(%d, %d) = %d, want %d", c.num, c.maxCount, got, c.want)
+		}
+	}
+
+	store := &partLimit{ObjectStorage: mem.NewMemClient("t"), max: 2, sizes: make(map[int]int)}
+	fs := mountTest(t, store, t.TempDir(), false, true, "")
+	f, h := createTest(t, rootDir(fs), "f")
+	data := testData(3*UploadPartSize, 12)
+	writeTest(t, h, data, 0)
+	flushTest(t, h)
+	releaseTest(t, h)
+	if store.sizes[1] != UploadPartSize || store.sizes[2] != 2*UploadPartSize {
+		t.Fatalf("parts uploaded in sizes %v", store.sizes)
+	}
+	if !bytes.Equal(readFile(t, f), data) {
+		t.Fatalf("file of growing parts read back wrong data")
+	}
+
+	// a write past the last part fails before the upload does
+	_, h = createTest(t, rootDir(fs), "g")
+	defer releaseTest(t, h)
+	writeTest(t, h, data, 0)
+	if err := writeData(h, []byte("x"), int64(len(data))); err == nil {
+		t.Fatalf("write past the part count limit succeeded")
+	}
+}
@@ -0,0 +1,399 @@
+package meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	RootInode = 1
+
+	dbName = "meta.db"
+)
+
+var (
+	inodeBucket  = []byte("inodes")
+	dentryBucket = []byte("dentries")
+	refBucket    = []byte("refs")
+
+	ErrNotFound = errors.New("meta: not found")
+	// ErrNoRefs is returned by Refs for a store whose chunk references
+	// were never counted.
+	ErrNoRefs = errors.New("meta: chunk references not counted")
+)
+
+// Inode is the persisted state of a file or directory.
+type Inode struct {
+	Ino   uint64      `json:"ino"`
+	Type  uint32      `json:"type"`
+	Mode  os.FileMode `json:"mode"`
+	Uid   uint32      `json:"uid"`
+	Gid   uint32      `json:"gid"`
+	Size  uint64      `json:"size"`
+	Nlink uint32      `json:"nlink"`
+	Atime time.Time   `json:"atime"`
+	Mtime time.Time   `json:"mtime"`
+	Ctime time.Time   `json:"ctime"`
+	// Key is the object holding the data of a file that has been linked
+	// more than once, "" means the path of its only link.
+	Key string `json:"key,omitempty"`
+	// Target is the target path of a symlink.
+	Target string `json:"target,omitempty"`
+	// Layout is the encoded chunk layout of a chunked file, the same
+	// bytes that are stored in the <key>/.meta object.
+	Layout []byte `json:"layout,omitempty"`
+}
+
+// Dentry is a name in a directory pointing at an inode.
+type Dentry struct {
+	Parent uint64
+	Name   string
+	Ino    uint64
+}
+
+type Meta struct {
+	db *bolt.DB
+	// refs returns the chunks referenced by a layout, see SetRefs.
+	refs func(layout []byte) []string
+}
+
+// Open opens or creates the metadata database under dir.
+func Open(dir string) (*Meta, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, dbName), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{inodeBucket, dentryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Meta{db: db}, nil
+}
+
+// OpenExisting opens the metadata database under dir like Open, but fails
+// when there is none instead of creating it.
+func OpenExisting(dir string) (*Meta, error) {
+	if _, err := os.Stat(filepath.Join(dir, dbName)); err != nil {
+		return nil, err
+	}
+	return Open(dir)
+}
+
+func (m *Meta) Close() error {
+	return m.db.Close()
+}
+
+// SetRefs makes the store count the references from the layouts of the
+// stored inodes to chunks, refs returns the chunks a layout references. The
+// counts are built from the stored layouts the first time.
+func (m *Meta) SetRefs(refs func(layout []byte) []string) error {
+	m.refs = refs
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(refBucket) != nil {
+			return nil
+		}
+		if _, err := tx.CreateBucket(refBucket); err != nil {
+			return err
+		}
+		return tx.Bucket(inodeBucket).ForEach(func(k, v []byte) error {
+			i := &Inode{}
+			if err := json.Unmarshal(v, i); err != nil {
+				return err
+			}
+			return m.ref(tx, i.Layout, 1)
+		})
+	})
+}
+
+// Refs returns the number of references to each referenced chunk.
+func (m *Meta) Refs() (map[string]uint64, error) {
+	refs := make(map[string]uint64)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(refBucket)
+		if b == nil {
+			return ErrNoRefs
+		}
+		return b.ForEach(func(k, v []byte) error {
+			refs[string(k)] = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	})
+	return refs, err
+}
+
+// ref adds delta to the counts of the chunks referenced by layout.
+func (m *Meta) ref(tx *bolt.Tx, layout []byte, delta int64) error {
+	if m.refs == nil || len(layout) == 0 {
+		return nil
+	}
+	b := tx.Bucket(refBucket)
+	for _, chunk := range m.refs(layout) {
+		k := []byte(chunk)
+		var n int64
+		if v := b.Get(k); v != nil {
+			n = int64(binary.BigEndian.Uint64(v))
+		}
+		n += delta
+		if n <= 0 {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			continue
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(n))
+		if err := b.Put(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func inodeKey(ino uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, ino)
+	return k
+}
+
+func dentryKey(parent uint64, name string) []byte {
+	k := make([]byte, 8+len(name))
+	binary.BigEndian.PutUint64(k, parent)
+	copy(k[8:], name)
+	return k
+}
+
+// NextInode allocates a new inode number, it never returns RootInode.
+func (m *Meta) NextInode() (uint64, error) {
+	var ino uint64
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(inodeBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		ino = seq + RootInode
+		return nil
+	})
+	return ino, err
+}
+
+func getInode(tx *bolt.Tx, ino uint64) (*Inode, error) {
+	v := tx.Bucket(inodeBucket).Get(inodeKey(ino))
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	i := &Inode{}
+	if err := json.Unmarshal(v, i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// putInode stores i, the references of its layout replace those of the
+// layout stored before.
+func (m *Meta) putInode(tx *bolt.Tx, i *Inode) error {
+	v, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	if m.refs != nil {
+		var old []byte
+		if o, err := getInode(tx, i.Ino); err == nil {
+			old = o.Layout
+		} else if err != ErrNotFound {
+			return err
+		}
+		if !bytes.Equal(old, i.Layout) {
+			if err := m.ref(tx, old, -1); err != nil {
+				return err
+			}
+			if err := m.ref(tx, i.Layout, 1); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket(inodeBucket).Put(inodeKey(i.Ino), v)
+}
+
+func (m *Meta) GetInode(ino uint64) (*Inode, error) {
+	var i *Inode
+	err := m.db.View(func(tx *bolt.Tx) error {
+		var err error
+		i, err = getInode(tx, ino)
+		return err
+	})
+	return i, err
+}
+
+func (m *Meta) PutInode(i *Inode) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return m.putInode(tx, i)
+	})
+}
+
+// Update applies fn to the stored inode and writes it back atomically.
+func (m *Meta) Update(ino uint64, fn func(i *Inode)) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		i, err := getInode(tx, ino)
+		if err != nil {
+			return err
+		}
+		fn(i)
+		return m.putInode(tx, i)
+	})
+}
+
+// Create stores the inode and links it as name under parent.
+func (m *Meta) Create(parent uint64, name string, i *Inode) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if err := m.putInode(tx, i); err != nil {
+			return err
+		}
+		return tx.Bucket(dentryBucket).Put(dentryKey(parent, name), inodeKey(i.Ino))
+	})
+}
+
+// CreateAll stores the inodes and links them as the dentries say, all in one
+// transaction.
+func (m *Meta) CreateAll(inodes []*Inode, dentries []Dentry) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		for _, i := range inodes {
+			if err := m.putInode(tx, i); err != nil {
+				return err
+			}
+		}
+		b := tx.Bucket(dentryBucket)
+		for _, d := range dentries {
+			if err := b.Put(dentryKey(d.Parent, d.Name), inodeKey(d.Ino)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Link adds name under parent as another link to the inode ino, fn
+// updates the stored inode in the same transaction.
+func (m *Meta) Link(parent uint64, name string, ino uint64, fn func(i *Inode)) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		i, err := getInode(tx, ino)
+		if err != nil {
+			return err
+		}
+		fn(i)
+		if err := m.putInode(tx, i); err != nil {
+			return err
+		}
+		return tx.Bucket(dentryBucket).Put(dentryKey(parent, name), inodeKey(ino))
+	})
+}
+
+// Unlink removes name from parent while other links keep the inode ino
+// alive, fn updates the stored inode in the same transaction.
+func (m *Meta) Unlink(parent uint64, name string, ino uint64, fn func(i *Inode)) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		i, err := getInode(tx, ino)
+		if err != nil {
+			return err
+		}
+		fn(i)
+		if err := m.putInode(tx, i); err != nil {
+			return err
+		}
+		return tx.Bucket(dentryBucket).Delete(dentryKey(parent, name))
+	})
+}
+
+// Remove unlinks name from parent and drops its inode along with the
+// references of its layout.
+func (m *Meta) Remove(parent uint64, name string, ino uint64) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(dentryBucket).Delete(dentryKey(parent, name)); err != nil {
+			return err
+		}
+		if i, err := getInode(tx, ino); err == nil {
+			if err := m.ref(tx, i.Layout, -1); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(inodeBucket).Delete(inodeKey(ino))
+	})
+}
+
+// Rename moves the entry name of parent to newName under newParent. The
+// inode of an entry already at newName is dropped along with the references
+// of its layout, unless unlink is set: that inode is still linked elsewhere
+// and unlink updates it for the lost link.
+func (m *Meta) Rename(parent uint64, name string, newParent uint64, newName string, unlink func(i *Inode)) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dentryBucket)
+		v := b.Get(dentryKey(parent, name))
+		if v == nil {
+			return ErrNotFound
+		}
+		ino := append([]byte(nil), v...)
+		if old := b.Get(dentryKey(newParent, newName)); old != nil && !bytes.Equal(old, ino) {
+			if err := m.replace(tx, binary.BigEndian.Uint64(old), unlink); err != nil {
+				return err
+			}
+		}
+		if err := b.Delete(dentryKey(parent, name)); err != nil {
+			return err
+		}
+		return b.Put(dentryKey(newParent, newName), ino)
+	})
+}
+
+// replace drops the inode ino whose entry a rename overwrites, or updates it
+// with unlink when it has other links.
+func (m *Meta) replace(tx *bolt.Tx, ino uint64, unlink func(i *Inode)) error {
+	i, err := getInode(tx, ino)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if unlink != nil {
+		unlink(i)
+		return m.putInode(tx, i)
+	}
+	if err := m.ref(tx, i.Layout, -1); err != nil {
+		return err
+	}
+	return tx.Bucket(inodeBucket).Delete(inodeKey(ino))
+}
+
+// ReadDir returns all entries of the directory parent.
+func (m *Meta) ReadDir(parent uint64) ([]Dentry, error) {
+	var entries []Dentry
+	prefix := inodeKey(parent)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(dentryBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && len(k) >= 8 && binary.BigEndian.Uint64(k) == parent; k, v = c.Next() {
+			entries = append(entries, Dentry{
+				Parent: parent,
+				Name:   string(k[8:]),
+				Ino:    binary.BigEndian.Uint64(v),
+			})
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,278 @@
+package meta
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTest(t *testing.T, dir string) *Meta {
+	m, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open %s: %v", dir, err)
+	}
+	return m
+}
+
+func TestPersistAcrossOpen(t *testing.T) {
+	dir := t.TempDir()
+	m := openTest(t, dir)
+	ino, err := m.NextInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ino == RootInode {
+		t.Fatalf("NextInode returned the root inode")
+	}
+	ts := time.Unix(1600000000, 0).UTC()
+	want := &Inode{
+		Ino:    ino,
+		Type:   8,
+		Mode:   0644,
+		Uid:    1000,
+		Gid:    1000,
+		Size:   42,
+		Nlink:  1,
+		Atime:  ts,
+		Mtime:  ts,
+		Ctime:  ts,
+		Layout: []byte("layout"),
+	}
+	if err := m.Create(RootInode, "f", want); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m = openTest(t, dir)
+	defer m.Close()
+	entries, err := m.ReadDir(RootInode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "f" || entries[0].Ino != ino {
+		t.Fatalf("ReadDir after reopen = %+v", entries)
+	}
+	got, err := m.GetInode(ino)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetInode after reopen = %+v, want %+v", got, want)
+	}
+	next, err := m.NextInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= ino {
+		t.Fatalf("NextInode after reopen = %d, reuses %d", next, ino)
+	}
+}
+
+func TestReadDirOnlyListsParent(t *testing.T) {
+	m := openTest(t, t.TempDir())
+	defer m.Close()
+	for _, e := range []Dentry{{RootInode, "a", 2}, {2, "b", 3}, {RootInode, "c", 4}, {256, "d", 5}} {
+		if err := m.Create(e.Parent, e.Name, &Inode{Ino: e.Ino}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := m.ReadDir(RootInode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Dentry{{RootInode, "a", 2}, {RootInode, "c", 4}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("ReadDir = %+v, want %+v", entries, want)
+	}
+}
+
+func TestCreateAll(t *testing.T) {
+	m := openTest(t, t.TempDir())
+	defer m.Close()
+	inodes := []*Inode{{Ino: RootInode}, {Ino: 2}, {Ino: 3}}
+	dentries := []Dentry{{RootInode, "a", 2}, {2, "b", 3}}
+	if err := m.CreateAll(inodes, dentries); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range inodes {
+		if _, err := m.GetInode(i.Ino); err != nil {
+			t.Fatalf("inode %d: %v", i.Ino, err)
+		}
+	}
+	entries, err := m.ReadDir(2)
+	if err != nil || !reflect.DeepEqual(entries, dentries[1:]) {
+		t.Fatalf("ReadDir = %+v, %v, want %+v", entries, err, dentries[1:])
+	}
+}
+
+func TestRenameAndRemove(t *testing.T) {
+	m := openTest(t, t.TempDir())
+	defer m.Close()
+	if err := m.Create(RootInode, "a", &Inode{Ino: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Create(RootInode, "d", &Inode{Ino: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rename(RootInode, "a", 3, "b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rename(RootInode, "a", 3, "b", nil); err != ErrNotFound {
+		t.Fatalf("Rename of a missing entry = %v, want ErrNotFound", err)
+	}
+	entries, _ := m.ReadDir(3)
+	if len(entries) != 1 || entries[0].Name != "b" || entries[0].Ino != 2 {
+		t.Fatalf("ReadDir after rename = %+v", entries)
+	}
+
+	if err := m.Remove(3, "b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := m.ReadDir(3); len(entries) != 0 {
+		t.Fatalf("ReadDir after remove = %+v", entries)
+	}
+	if _, err := m.GetInode(2); err != ErrNotFound {
+		t.Fatalf("GetInode after remove = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRenameReplaces(t *testing.T) {
+	m := openTest(t, t.TempDir())
+	defer m.Close()
+	for _, e := range []Dentry{{RootInode, "a", 2}, {RootInode, "b", 3}, {RootInode, "c", 4}, {RootInode, "d", 4}} {
+		if err := m.Create(e.Parent, e.Name, &Inode{Ino: e.Ino, Nlink: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b has no other link and goes away
+	if err := m.Rename(RootInode, "a", RootInode, "b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetInode(3); err != ErrNotFound {
+		t.Fatalf("GetInode of the replaced inode = %v, want ErrNotFound", err)
+	}
+	// c is still linked as d
+	if err := m.Rename(RootInode, "b", RootInode, "c", func(i *Inode) { i.Nlink = 7 }); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := m.GetInode(4); err != nil || i.Nlink != 7 {
+		t.Fatalf("GetInode of the unlinked inode = %+v, %v", i, err)
+	}
+	entries, _ := m.ReadDir(RootInode)
+	want := []Dentry{{RootInode, "c", 2}, {RootInode, "d", 4}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("ReadDir after rename = %+v, want %+v", entries, want)
+	}
+}
+
+func TestLinkAndUnlink(t *testing.T) {
+	m := openTest(t, t.TempDir())
+	defer m.Close()
+	if err := m.Create(RootInode, "a", &Inode{Ino: 2, Nlink: 1}); err != nil {
+		t.Fatal(err)
+	}
+	err := m.Link(RootInode, "b", 2, func(i *Inode) {
+		i.Nlink = 2
+		i.Key = "a"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := m.ReadDir(RootInode)
+	if len(entries) != 2 || entries[0].Ino != 2 || entries[1].Ino != 2 {
+		t.Fatalf("ReadDir after link = %+v", entries)
+	}
+	if err := m.Unlink(RootInode, "a", 2, func(i *Inode) { i.Nlink = 1 }); err != nil {
+		t.Fatal(err)
+	}
+	i, err := m.GetInode(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Nlink != 1 || i.Key != "a" {
+		t.Fatalf("inode after unlink = %+v", i)
+	}
+	entries, _ = m.ReadDir(RootInode)
+	if len(entries) != 1 || entries[0].Name != "b" {
+		t.Fatalf("ReadDir after unlink = %+v", entries)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	m := openTest(t, t.TempDir())
+	defer m.Close()
+	if err := m.Update(2, func(i *Inode) {}); err != ErrNotFound {
+		t.Fatalf("Update of a missing inode = %v, want ErrNotFound", err)
+	}
+	if err := m.PutInode(&Inode{Ino: 2, Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(2, func(i *Inode) { i.Size = 7; i.Mode = os.ModeSymlink }); err != nil {
+		t.Fatal(err)
+	}
+	i, _ := m.GetInode(2)
+	if i.Size != 7 || i.Mode != os.ModeSymlink {
+		t.Fatalf("inode after update = %+v", i)
+	}
+}
+
+// splitRefs reads a test layout as the names of the chunks it references.
+func splitRefs(layout []byte) []string {
+	return strings.Fields(string(layout))
+}
+
+func TestRefs(t *testing.T) {
+	dir := t.TempDir()
+	m := openTest(t, dir)
+	if _, err := m.Refs(); err != ErrNoRefs {
+		t.Fatalf("Refs before SetRefs = %v, want ErrNoRefs", err)
+	}
+	// layouts stored before the counting started are counted
+	m.PutInode(&Inode{Ino: 2, Layout: []byte("a b")})
+	if err := m.SetRefs(splitRefs); err != nil {
+		t.Fatal(err)
+	}
+	m.Create(RootInode, "f", &Inode{Ino: 3, Nlink: 1, Layout: []byte("b c")})
+	m.Update(2, func(i *Inode) { i.Layout = []byte("a") })
+	refs, err := m.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]uint64{"a": 1, "b": 1, "c": 1}; !reflect.DeepEqual(refs, want) {
+		t.Fatalf("Refs = %v, want %v", refs, want)
+	}
+	if err := m.Remove(RootInode, "f", 3); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	// the counts are kept across an open, chunks no longer referenced are
+	// dropped
+	m = openTest(t, dir)
+	defer m.Close()
+	refs, err = m.Refs()
+	if want := map[string]uint64{"a": 1}; err != nil || !reflect.DeepEqual(refs, want) {
+		t.Fatalf("Refs after reopen = %v, %v, want %v", refs, err, want)
+	}
+}
+
+func TestOpenExisting(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	if _, err := OpenExisting(dir); err == nil {
+		t.Fatalf("OpenExisting of a missing store succeeded")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("OpenExisting created %s", dir)
+	}
+	openTest(t, dir).Close()
+	m, err := OpenExisting(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+}